@@ -8,9 +8,19 @@ import (
 )
 
 const (
-	configFlag = "config"
-	reloadFlag = "reload"
-	debugFlag  = "debug"
+	configFlag               = "config"
+	reloadFlag               = "reload"
+	debugFlag                = "debug"
+	tcpNoDelayFlag           = "tcp-nodelay"
+	tcpUserTimeoutFlag       = "tcp-user-timeout"
+	tcpKeepAliveIdleFlag     = "tcp-keepalive-idle"
+	tcpKeepAliveIntervalFlag = "tcp-keepalive-interval"
+	tcpKeepAliveCountFlag    = "tcp-keepalive-count"
+	tcpSendBufferFlag        = "tcp-send-buffer"
+	tcpReceiveBufferFlag     = "tcp-receive-buffer"
+	mptcpFlag                = "mptcp"
+	apiFlag                  = "api"
+	captureDirFlag           = "capture-dir"
 )
 
 // ShowVersion shows the clabernetes version information for clabernetes CLI tools.
@@ -46,12 +56,116 @@ func Entrypoint() *cli.App {
 				Required: false,
 				Value:    false,
 			},
+			&cli.BoolFlag{
+				Name:     tcpNoDelayFlag,
+				Usage:    "set TCP_NODELAY on tunnel connections",
+				Required: false,
+				Value:    true,
+			},
+			&cli.DurationFlag{
+				Name:     tcpUserTimeoutFlag,
+				Usage:    "TCP_USER_TIMEOUT for tunnel connections, 0 for kernel default",
+				Required: false,
+				Value:    0,
+			},
+			&cli.DurationFlag{
+				Name:     tcpKeepAliveIdleFlag,
+				Usage:    "idle time (min 1s) before keepalive probes, 0 for kernel default",
+				Required: false,
+				Value:    0,
+			},
+			&cli.DurationFlag{
+				Name:     tcpKeepAliveIntervalFlag,
+				Usage:    "interval (min 1s) between keepalive probes, 0 for kernel default",
+				Required: false,
+				Value:    0,
+			},
+			&cli.IntFlag{
+				Name:     tcpKeepAliveCountFlag,
+				Usage:    "unanswered keepalive probes before dropping, 0 for kernel default",
+				Required: false,
+				Value:    0,
+			},
+			&cli.IntFlag{
+				Name:     tcpSendBufferFlag,
+				Usage:    "tunnel connection send buffer size in bytes, 0 for kernel default",
+				Required: false,
+				Value:    0,
+			},
+			&cli.IntFlag{
+				Name:     tcpReceiveBufferFlag,
+				Usage:    "tunnel connection receive buffer size in bytes, 0 for kernel default",
+				Required: false,
+				Value:    0,
+			},
+			&cli.BoolFlag{
+				Name:     mptcpFlag,
+				Usage:    "enable multipath tcp for tunnel connections, falls back to tcp",
+				Required: false,
+				Value:    false,
+			},
+			&cli.StringFlag{
+				Name:     apiFlag,
+				Usage:    "address (host:port) for the runtime http api, empty to disable",
+				Required: false,
+				Value:    "",
+			},
+			&cli.StringFlag{
+				Name:     captureDirFlag,
+				Usage:    "directory for packet captures started via the api",
+				Required: false,
+				Value:    "",
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "scenario",
+				Usage: "drive segments of a running slurpeeth instance",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "run",
+						Usage:     "run a scenario file via the api, waiting until it is done",
+						ArgsUsage: "<file>",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     apiFlag,
+								Usage:    "address (host:port) of the slurpeeth runtime http api",
+								Required: true,
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							if ctx.NArg() != 1 {
+								return fmt.Errorf(
+									"%w: expected exactly one scenario file",
+									slurpeeth.ErrConfig,
+								)
+							}
+
+							return slurpeeth.RunScenario(ctx.String(apiFlag), ctx.Args().First())
+						},
+					},
+				},
+			},
 		},
 		Action: func(ctx *cli.Context) error {
 			m, err := slurpeeth.GetManager(
 				slurpeeth.WithConfigFile(ctx.String(configFlag)),
 				slurpeeth.WithLiveReload(ctx.Bool(reloadFlag)),
 				slurpeeth.WithDebug(ctx.Bool(debugFlag)),
+				slurpeeth.WithTCPNoDelay(ctx.Bool(tcpNoDelayFlag)),
+				slurpeeth.WithTCPUserTimeout(ctx.Duration(tcpUserTimeoutFlag)),
+				slurpeeth.WithTCPKeepAlive(
+					ctx.Duration(tcpKeepAliveIdleFlag),
+					ctx.Duration(tcpKeepAliveIntervalFlag),
+					ctx.Int(tcpKeepAliveCountFlag),
+				),
+				slurpeeth.WithTCPBufferSizes(
+					ctx.Int(tcpSendBufferFlag),
+					ctx.Int(tcpReceiveBufferFlag),
+				),
+				slurpeeth.WithMultipathTCP(ctx.Bool(mptcpFlag)),
+				slurpeeth.WithAPIAddress(ctx.String(apiFlag)),
+				slurpeeth.WithCaptureDirectory(ctx.String(captureDirFlag)),
 			)
 			if err != nil {
 				return err
@@ -0,0 +1,182 @@
+package slurpeeth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// adminDownReason is the pause reason of segments that are set admin down.
+const adminDownReason = "admin down"
+
+func validateLinkDown(link string) error {
+	switch link {
+	case "", LinkDownCarrier, LinkDownAdmin:
+		return nil
+	default:
+		return fmt.Errorf("%w: unsupported link down mode %q", ErrConfig, link)
+	}
+}
+
+// setAdminDown pauses the segment and, if link is set, also forces the link of each of the
+// segment's local interfaces down -- "carrier" clears the interface's carrier, "admin" clears its
+// IFF_UP flag (for a veth the far end then loses carrier, which is what a router on the far end
+// sees as a pulled cable).
+func (w *Worker) setAdminDown(link string) error {
+	err := validateLinkDown(link)
+	if err != nil {
+		return err
+	}
+
+	w.pause(adminDownReason)
+
+	log.Printf("set tunnel id %d admin down", w.segment.ID)
+
+	if link == "" {
+		return nil
+	}
+
+	var errs []error
+
+	for idx := range w.interfaces {
+		err = w.forceLinkDown(idx, link)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	w.propagateLinkState()
+
+	return errors.Join(errs...)
+}
+
+// setAdminUp restores any links forced down by setAdminDown and resumes the segment.
+func (w *Worker) setAdminUp() error {
+	err := w.restoreLinks()
+
+	w.propagateLinkState()
+
+	if w.resume() {
+		log.Printf("set tunnel id %d admin up", w.segment.ID)
+	}
+
+	return err
+}
+
+// restoreLinks restores the links of all interfaces that were forced down.
+func (w *Worker) restoreLinks() error {
+	var errs []error
+
+	for idx := range w.interfaces {
+		err := w.restoreLink(idx)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// releaseLinks restores any forced down links when the worker stops, we never want to leave an
+// interface down behind us.
+func (w *Worker) releaseLinks() {
+	err := w.restoreLinks()
+	if err != nil {
+		log.Printf(
+			"failed restoring links for worker for tunnel id %d, err: %s", w.segment.ID, err,
+		)
+	}
+}
+
+// forceLinkDown forces the link of interface idx down per mode, interfaces that do not exist
+// (yet) are skipped.
+func (w *Worker) forceLinkDown(idx int, mode string) error {
+	i := w.interfaces[idx]
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.waiting || i.linkForced != "" {
+		return nil
+	}
+
+	err := i.setLinkState(mode, false)
+	if err != nil {
+		return err
+	}
+
+	i.linkForced = mode
+
+	log.Printf(
+		"forced %s of interface %q for tunnel id %d down", mode, i.name, w.segment.ID,
+	)
+
+	return nil
+}
+
+// restoreLink brings the link of interface idx back up if it was forced down.
+func (w *Worker) restoreLink(idx int) error {
+	i := w.interfaces[idx]
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.linkForced == "" {
+		return nil
+	}
+
+	mode := i.linkForced
+
+	// forget it either way, if the interface is gone there is nothing left to restore
+	i.linkForced = ""
+	i.linkForcedRemote = false
+	i.restoredAt = time.Now()
+
+	// re-check once the link had time to come up
+	time.AfterFunc(linkSettleTime, w.propagateLinkState)
+
+	if i.waiting {
+		return nil
+	}
+
+	err := i.setLinkState(mode, true)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("restored %s of interface %q for tunnel id %d", mode, i.name, w.segment.ID)
+
+	return nil
+}
+
+// setLinkState sets the carrier or admin state (per mode) of the interface, i.mu must be held.
+func (i *interfaceWorker) setLinkState(mode string, up bool) error {
+	err := runInNetns(i.namespace, func() error {
+		ifindex := i.ifindex
+
+		if i.create != "" {
+			// we created it, so we never looked it up
+			createdInterface, err := net.InterfaceByName(i.name)
+			if err != nil {
+				return err
+			}
+
+			ifindex = createdInterface.Index
+		}
+
+		if mode == LinkDownCarrier {
+			return setLinkCarrier(ifindex, up)
+		}
+
+		return setLinkAdminState(ifindex, up)
+	})
+	if err != nil {
+		return fmt.Errorf(
+			"%w: failed setting %s of interface %q, error: %w", ErrBind, mode, i.name, err,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,431 @@
+package slurpeeth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiReadHeaderTimeout = 10 * time.Second
+
+// startAPI starts the runtime http/json api (if an api address is set) -- the api is for
+// inspecting and poking at running segments, it is not authenticated so should only be bound to
+// a trusted address.
+func (m *manager) startAPI() error {
+	if m.apiAddress == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/segments", m.handleSegments)
+	mux.HandleFunc("/segments/", m.handleSegment)
+	mux.HandleFunc("/scenarios", m.handleScenarios)
+	mux.HandleFunc("/scenarios/", m.handleScenario)
+
+	// listen here rather than in the goroutine so a bad address fails startup
+	lis, err := net.Listen(TCP, m.apiAddress)
+	if err != nil {
+		return fmt.Errorf(
+			"%w: failed listening on api address %q, error: %w", ErrConfig, m.apiAddress, err,
+		)
+	}
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: apiReadHeaderTimeout,
+	}
+
+	go func() {
+		serveErr := server.Serve(lis)
+		if serveErr != nil && !errors.Is(serveErr, http.ErrServerClosed) {
+			m.errChan <- serveErr
+		}
+	}()
+
+	go func() {
+		<-m.ctx.Done()
+
+		_ = server.Close()
+	}()
+
+	log.Printf("api listening on %q", lis.Addr())
+
+	return nil
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("failed writing api response, err: %s", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIResponse(w, status, apiError{Error: err.Error()})
+}
+
+// segmentStatus is the api representation of a running segment.
+type segmentStatus struct {
+	ID           uint16              `json:"id"`
+	Name         string              `json:"name"`
+	Mode         string              `json:"mode"`
+	Interfaces   []interfaceStatus   `json:"interfaces"`
+	Destinations []destinationStatus `json:"destinations"`
+	Paused       bool                `json:"paused"`
+	PauseReason  string              `json:"pauseReason,omitempty"`
+	StormControl *stormControlStatus `json:"stormControl,omitempty"`
+}
+
+type interfaceStatus struct {
+	Name               string `json:"name"`
+	Bound              bool   `json:"bound"`
+	SuppressedOutgoing uint64 `json:"suppressedOutgoing"`
+	LinkForced         string `json:"linkForced,omitempty"`
+	LinkForcedByPeer   bool   `json:"linkForcedByPeer,omitempty"`
+}
+
+type destinationStatus struct {
+	Name string `json:"name"`
+	// Multipath is whether the current connection negotiated mptcp, unset if the destination was
+	// not dialed (yet) or is reached via a command.
+	Multipath string `json:"multipath,omitempty"`
+	// Dropped is the number of messages dropped because the destination's queue was full.
+	Dropped uint64 `json:"dropped"`
+}
+
+func (w *Worker) status() segmentStatus {
+	status := segmentStatus{
+		ID:           w.segment.ID,
+		Name:         w.segment.Name,
+		Mode:         w.segment.Mode,
+		Interfaces:   make([]interfaceStatus, len(w.interfaces)),
+		Destinations: make([]destinationStatus, len(w.destinations)),
+	}
+
+	if status.Mode == "" {
+		status.Mode = SegmentModeHub
+	}
+
+	status.Paused, status.PauseReason = w.pauseState()
+	status.StormControl = w.stormControlStatus()
+
+	for idx := range w.interfaces {
+		status.Interfaces[idx] = interfaceStatus{
+			Name:               w.interfaces[idx].name,
+			Bound:              w.interfaces[idx].currentIO() != nil,
+			SuppressedOutgoing: w.interfaces[idx].suppressedOutgoing.Load(),
+		}
+
+		w.interfaces[idx].mu.Lock()
+		status.Interfaces[idx].LinkForced = w.interfaces[idx].linkForced
+		status.Interfaces[idx].LinkForcedByPeer = w.interfaces[idx].linkForcedRemote
+		w.interfaces[idx].mu.Unlock()
+	}
+
+	for idx := range w.destinations {
+		status.Destinations[idx] = destinationStatus{
+			Name:    w.destinations[idx].name,
+			Dropped: w.destinations[idx].dropped.Load(),
+		}
+
+		multipath := w.destinations[idx].multipath.Load()
+		if multipath != nil {
+			status.Destinations[idx].Multipath = *multipath
+		}
+	}
+
+	return status
+}
+
+// handleSegments handles "/segments" -- listing all segments.
+func (m *manager) handleSegments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+
+		return
+	}
+
+	workers := m.workerList()
+
+	statuses := make([]segmentStatus, 0, len(workers))
+
+	for _, worker := range workers {
+		statuses = append(statuses, worker.status())
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+
+	writeAPIResponse(w, http.StatusOK, statuses)
+}
+
+// handleSegment handles "/segments/<id>[/<resource>]".
+func (m *manager) handleSegment(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/segments/"), "/"), "/")
+
+	id, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid segment id %q", parts[0]))
+
+		return
+	}
+
+	worker, ok := m.getWorker(uint16(id))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no segment with id %d", id))
+
+		return
+	}
+
+	resource := strings.Join(parts[1:], "/")
+
+	switch {
+	case resource == "" && r.Method == http.MethodGet:
+		writeAPIResponse(w, http.StatusOK, worker.status())
+	case resource == "macs" && r.Method == http.MethodGet:
+		if worker.macTable == nil {
+			writeAPIError(
+				w, http.StatusConflict, fmt.Errorf("segment %d is not in switch mode", id),
+			)
+
+			return
+		}
+
+		writeAPIResponse(w, http.StatusOK, worker.macTableEntries())
+	case resource == "down" && r.Method == http.MethodPost:
+		handleAdminDown(w, r, worker)
+	case resource == "up" && r.Method == http.MethodPost:
+		err = worker.setAdminUp()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+
+		writeAPIResponse(w, http.StatusOK, worker.status())
+	case resource == "capture":
+		m.handleCapture(w, r, worker)
+	case resource == "shaping" && r.Method == http.MethodGet:
+		if worker.segment.Shaping == nil {
+			writeAPIError(w, http.StatusConflict, fmt.Errorf("segment %d is not shaped", id))
+
+			return
+		}
+
+		writeAPIResponse(w, http.StatusOK, worker.shaperStats())
+	case resource == "impairments" && r.Method == http.MethodGet:
+		egress := worker.egressImpairer.get()
+		ingress := worker.ingressImpairer.get()
+
+		writeAPIResponse(w, http.StatusOK, Impairments{Egress: &egress, Ingress: &ingress})
+	case strings.HasPrefix(resource, "impairments/"):
+		handleImpairment(w, r, worker, strings.TrimPrefix(resource, "impairments/"))
+	default:
+		writeAPIError(
+			w, http.StatusNotFound, fmt.Errorf("no route for %s %s", r.Method, r.URL.Path),
+		)
+	}
+}
+
+// handleImpairment handles "/segments/<id>/impairments/<direction>" -- GET returns, PUT replaces
+// and DELETE clears the impairment of one direction of the segment.
+func handleImpairment(w http.ResponseWriter, r *http.Request, worker *Worker, direction string) {
+	var i *impairer
+
+	switch direction {
+	case "egress":
+		i = worker.egressImpairer
+	case "ingress":
+		i = worker.ingressImpairer
+	default:
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("unknown direction %q", direction))
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var impairment Impairment
+
+		err := json.NewDecoder(r.Body).Decode(&impairment)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+
+			return
+		}
+
+		err = impairment.validate()
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+
+			return
+		}
+
+		i.set(impairment)
+
+		encoded, _ := json.Marshal(impairment)
+
+		log.Printf(
+			"set %s impairment for tunnel id %d to %s", direction, worker.segment.ID, encoded,
+		)
+	case http.MethodDelete:
+		i.set(Impairment{})
+
+		log.Printf("cleared %s impairment for tunnel id %d", direction, worker.segment.ID)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+
+		return
+	}
+
+	writeAPIResponse(w, http.StatusOK, i.get())
+}
+
+// adminDownRequest is the (optional) body of "/segments/<id>/down".
+type adminDownRequest struct {
+	// Link is how to force the segment's local interfaces down: "carrier", "admin" or empty to
+	// only stop forwarding.
+	Link string `json:"link"`
+}
+
+// handleAdminDown handles "/segments/<id>/down" -- pausing the segment and optionally forcing its
+// local interfaces down, "/segments/<id>/up" undoes it (and resumes err-disabled segments).
+func handleAdminDown(w http.ResponseWriter, r *http.Request, worker *Worker) {
+	var req adminDownRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeAPIError(w, http.StatusBadRequest, err)
+
+		return
+	}
+
+	err = validateLinkDown(req.Link)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+
+		return
+	}
+
+	err = worker.setAdminDown(req.Link)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+
+		return
+	}
+
+	writeAPIResponse(w, http.StatusOK, worker.status())
+}
+
+// handleCapture handles "/segments/<id>/capture" -- GET returns the state of the capture, PUT
+// starts (or restarts) capturing per the Capture in the body (see apiCapture) and DELETE stops
+// capturing.
+func (m *manager) handleCapture(w http.ResponseWriter, r *http.Request, worker *Worker) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		config, status, err := m.apiCapture(r, worker)
+		if err != nil {
+			writeAPIError(w, status, err)
+
+			return
+		}
+
+		err = worker.startCapture(config)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+
+			return
+		}
+	case http.MethodDelete:
+		if !worker.stopCapture() {
+			writeAPIError(
+				w,
+				http.StatusConflict,
+				fmt.Errorf("segment %d is not capturing", worker.segment.ID),
+			)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+		return
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+
+		return
+	}
+
+	c := worker.capture.Load()
+	if c == nil {
+		writeAPIError(
+			w, http.StatusConflict, fmt.Errorf("segment %d is not capturing", worker.segment.ID),
+		)
+
+		return
+	}
+
+	writeAPIResponse(w, http.StatusOK, c.status())
+}
+
+// apiCapture returns the capture a PUT to "/segments/<id>/capture" asks for. The api is not
+// authenticated and slurpeeth runs as root, so the api never picks arbitrary paths: a capture
+// without a path restarts the segment's configured capture, a capture with a path must be a plain
+// file name, and is written to the capture directory (if there is one).
+func (m *manager) apiCapture(r *http.Request, worker *Worker) (Capture, int, error) {
+	var config Capture
+
+	err := json.NewDecoder(r.Body).Decode(&config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Capture{}, http.StatusBadRequest, err
+	}
+
+	if config.Path == "" {
+		if worker.segment.Capture == nil {
+			return Capture{}, http.StatusBadRequest, fmt.Errorf(
+				"no capture path given and segment %d has no configured capture",
+				worker.segment.ID,
+			)
+		}
+
+		return *worker.segment.Capture, 0, nil
+	}
+
+	if m.captureDir == "" {
+		return Capture{}, http.StatusForbidden, fmt.Errorf(
+			"captures to a given path require a capture directory, without one only the" +
+				" configured capture can be (re)started",
+		)
+	}
+
+	if strings.ContainsRune(config.Path, filepath.Separator) || config.Path == "." ||
+		config.Path == ".." {
+		return Capture{}, http.StatusBadRequest, fmt.Errorf(
+			"capture path %q must be a file name in the capture directory", config.Path,
+		)
+	}
+
+	config.Path = filepath.Join(m.captureDir, config.Path)
+
+	return config, 0, nil
+}
@@ -0,0 +1,188 @@
+package slurpeeth
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// bpfLD and bpfW are both 0 (and so not in x/sys/unix), they are here for readability.
+	bpfLD = 0x00
+	bpfW  = 0x00
+
+	// bpfFuncRedirectMap is the helper id of bpf_redirect_map.
+	bpfFuncRedirectMap = 51
+
+	// xdpPass is the XDP_PASS action.
+	xdpPass = 2
+
+	// xdpMdRxQueueIndexOffset is the offset of rx_queue_index in struct xdp_md.
+	xdpMdRxQueueIndexOffset = 16
+
+	bpfLicense = "GPL"
+)
+
+// bpfInsn is an eBPF instruction (struct bpf_insn).
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst in the low nibble, src in the high nibble
+	off  int16
+	imm  int32
+}
+
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type bpfMapUpdateAttr struct {
+	mapFD uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+	progName    [16]byte
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(r), nil
+}
+
+// newXSKMap creates a BPF_MAP_TYPE_XSKMAP with room for entries sockets (one per queue).
+func newXSKMap(entries int) (int, error) {
+	attr := bpfMapCreateAttr{
+		mapType:    unix.BPF_MAP_TYPE_XSKMAP,
+		keySize:    4, //nolint:gomnd
+		valueSize:  4, //nolint:gomnd
+		maxEntries: uint32(entries),
+	}
+
+	fd, err := bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("%w: failed creating xsk map, error: %w", ErrBind, err)
+	}
+
+	return fd, nil
+}
+
+// updateXSKMap sets map[queue] = socket fd.
+func updateXSKMap(mapFD, queue, socketFD int) error {
+	key := uint32(queue)
+	value := uint32(socketFD)
+
+	attr := bpfMapUpdateAttr{
+		mapFD: uint32(mapFD),
+		key:   uint64(uintptr(unsafe.Pointer(&key))),
+		value: uint64(uintptr(unsafe.Pointer(&value))),
+	}
+
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(&value)
+
+	if err != nil {
+		return fmt.Errorf("%w: failed updating xsk map, error: %w", ErrBind, err)
+	}
+
+	return nil
+}
+
+// loadXSKRedirectProgram loads the xdp program that redirects every frame to the AF_XDP socket in
+// the given xsk map for the queue the frame arrived on -- or passes the frame to the stack if there
+// is no socket for that queue. It is the equivalent of:
+//
+//	return bpf_redirect_map(&xsks_map, ctx->rx_queue_index, XDP_PASS);
+func loadXSKRedirectProgram(mapFD int) (int, error) {
+	insns := []bpfInsn{
+		// r2 = ctx->rx_queue_index
+		{
+			code: unix.BPF_LDX | unix.BPF_MEM | bpfW,
+			regs: 2 | 1<<4, //nolint:gomnd
+			off:  xdpMdRxQueueIndexOffset,
+		},
+		// r1 = xsks map (a 64-bit immediate load, so two instructions)
+		{
+			code: bpfLD | unix.BPF_IMM | unix.BPF_DW,
+			regs: 1 | unix.BPF_PSEUDO_MAP_FD<<4,
+			imm:  int32(mapFD),
+		},
+		{},
+		// r3 = XDP_PASS (flags for bpf_redirect_map -- the action if there is no socket)
+		{
+			code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K,
+			regs: 3, //nolint:gomnd
+			imm:  xdpPass,
+		},
+		// r0 = bpf_redirect_map(r1, r2, r3)
+		{
+			code: unix.BPF_JMP | unix.BPF_CALL,
+			imm:  bpfFuncRedirectMap,
+		},
+		{
+			code: unix.BPF_JMP | unix.BPF_EXIT,
+		},
+	}
+
+	license := []byte(bpfLicense + "\x00")
+
+	attr := bpfProgLoadAttr{
+		progType: unix.BPF_PROG_TYPE_XDP,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+
+	copy(attr.progName[:], "slurpeeth_xsk")
+
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+
+	if err != nil {
+		return -1, fmt.Errorf("%w: failed loading xdp program, error: %w", ErrBind, err)
+	}
+
+	return fd, nil
+}
+
+// setLinkXDP attaches the xdp program progFD to the link with the given index, progFD of -1
+// detaches any program.
+func setLinkXDP(index, progFD int, flags uint32) error {
+	_, err := netlinkRouteRequest(
+		unix.RTM_SETLINK,
+		0,
+		encodeIfInfomsg(int32(index), 0, 0),
+		netlinkAttrNested(
+			unix.IFLA_XDP,
+			netlinkAttrUint32(unix.IFLA_XDP_FD, uint32(int32(progFD))),
+			netlinkAttrUint32(unix.IFLA_XDP_FLAGS, flags),
+		),
+	)
+
+	return err
+}
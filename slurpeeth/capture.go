@@ -0,0 +1,456 @@
+package slurpeeth
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	pcapngBlockSHB = 0x0A0D0D0A
+	pcapngBlockIDB = 0x00000001
+	pcapngBlockEPB = 0x00000006
+
+	pcapngByteOrderMagic = 0x1A2B3C4D
+
+	pcapngOptEnd      = 0
+	pcapngOptComment  = 1
+	pcapngOptIfName   = 2
+	pcapngOptEPBFlags = 2
+
+	pcapngLinkTypeEthernet = 1
+
+	// captureInbound and captureOutbound are the epb_flags direction values -- inbound for frames
+	// slurpeeth received from a member, outbound for frames it sent to a member.
+	captureInbound  = 1
+	captureOutbound = 2
+
+	captureFlushInterval = time.Second
+)
+
+// Capture holds the packet capture settings of a segment -- every frame passing through the
+// segment is written to pcapng files, with an interface (in the pcapng sense) per member of the
+// segment: each local interface, each remote sender and each destination. In the config this can
+// be just the path.
+type Capture struct {
+	// Path is the path of the capture file, when rotating files are numbered (capture.pcapng
+	// becomes capture-1.pcapng, capture-2.pcapng and so on).
+	Path string `yaml:"path" json:"path"`
+	// MaxSize is the size in bytes a file grows to before rotating to the next file, 0 to never
+	// rotate.
+	MaxSize int64 `yaml:"max-size" json:"maxSize,omitempty"`
+	// MaxFiles is how many rotated files are kept (the oldest are removed), 0 to keep all files.
+	MaxFiles int `yaml:"max-files" json:"maxFiles,omitempty"`
+}
+
+// UnmarshalYAML allows a capture to be given as just the path.
+func (c *Capture) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		c.Path = node.Value
+
+		return nil
+	}
+
+	type rawCapture Capture
+
+	var raw rawCapture
+
+	err := node.Decode(&raw)
+	if err != nil {
+		return err
+	}
+
+	*c = Capture(raw)
+
+	return nil
+}
+
+func (c *Capture) validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("%w: capture has no path", ErrConfig)
+	}
+
+	if c.MaxSize < 0 || c.MaxFiles < 0 {
+		return fmt.Errorf("%w: capture max-size and max-files can not be negative", ErrConfig)
+	}
+
+	return nil
+}
+
+// capture writes the frames of a segment to (rotating) pcapng files.
+type capture struct {
+	config Capture
+
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	// size and fileFrames are the size of and frames in the current file, files are the paths of
+	// the (kept) files written so far and fileCount how many files were written in total.
+	size       int64
+	fileFrames int
+	files      []string
+	fileCount  int
+	// members are the names of the pcapng interfaces (in order of their ids), memberIDs maps them
+	// back to ids -- every file gets all of them so ids stay the same across rotations.
+	members   []string
+	memberIDs map[string]uint32
+	frames    uint64
+	closed    bool
+	done      chan struct{}
+}
+
+func newCapture(config Capture) (*capture, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &capture{
+		config:    config,
+		memberIDs: map[string]uint32{},
+		done:      make(chan struct{}),
+	}
+
+	err = c.openFile()
+	if err != nil {
+		return nil, err
+	}
+
+	go c.flushPeriodically()
+
+	return c, nil
+}
+
+// nextPath returns the path of the next file to write.
+func (c *capture) nextPath() string {
+	if c.config.MaxSize == 0 {
+		return c.config.Path
+	}
+
+	ext := filepath.Ext(c.config.Path)
+
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(c.config.Path, ext), c.fileCount, ext)
+}
+
+// openFile opens the next capture file and writes the section header and all interface blocks,
+// c.mu must be held (or c not yet shared).
+func (c *capture) openFile() error {
+	c.fileCount++
+
+	path := c.nextPath()
+
+	// never follow a symlink someone left where a capture file goes
+	f, err := os.OpenFile(
+		path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|unix.O_NOFOLLOW, 0o644, //nolint:gomnd
+	)
+	if err != nil {
+		return fmt.Errorf("%w: failed creating capture file %q, error: %w", ErrConfig, path, err)
+	}
+
+	c.file = f
+	c.writer = bufio.NewWriter(f)
+	c.size = 0
+	c.fileFrames = 0
+	c.files = append(c.files, path)
+
+	c.writeBlock(pcapngBlockSHB, encodeSHB())
+
+	for _, member := range c.members {
+		c.writeBlock(pcapngBlockIDB, encodeIDB(member))
+	}
+
+	if c.config.MaxFiles > 0 && len(c.files) > c.config.MaxFiles {
+		old := c.files[0]
+		c.files = c.files[1:]
+
+		err = os.Remove(old)
+		if err != nil {
+			log.Printf("failed removing old capture file %q, err: %s", old, err)
+		}
+	}
+
+	return nil
+}
+
+// rotate closes the current file and opens the next one, c.mu must be held.
+func (c *capture) rotate() error {
+	err := c.closeFile()
+	if err != nil {
+		return err
+	}
+
+	return c.openFile()
+}
+
+func (c *capture) closeFile() error {
+	err := c.writer.Flush()
+	if err != nil {
+		_ = c.file.Close()
+
+		return err
+	}
+
+	return c.file.Close()
+}
+
+// writeBlock writes a pcapng block with body (which must be 32 bit aligned), c.mu must be held.
+func (c *capture) writeBlock(blockType uint32, body []byte) {
+	length := uint32(12 + len(body)) //nolint:gomnd
+
+	b := make([]byte, 0, length)
+	b = binary.NativeEndian.AppendUint32(b, blockType)
+	b = binary.NativeEndian.AppendUint32(b, length)
+	b = append(b, body...)
+	b = binary.NativeEndian.AppendUint32(b, length)
+
+	// write errors surface on flush, a capture is best effort anyway
+	_, _ = c.writer.Write(b)
+
+	c.size += int64(len(b))
+}
+
+// memberID returns the pcapng interface id of member, adding an interface block for new members,
+// c.mu must be held.
+func (c *capture) memberID(member string) uint32 {
+	id, ok := c.memberIDs[member]
+	if ok {
+		return id
+	}
+
+	id = uint32(len(c.members))
+
+	c.members = append(c.members, member)
+	c.memberIDs[member] = id
+
+	c.writeBlock(pcapngBlockIDB, encodeIDB(member))
+
+	return id
+}
+
+// write captures frame as seen on member in direction.
+func (c *capture) write(member string, direction uint32, frame Bytes) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	if c.config.MaxSize > 0 && c.size+int64(len(frame)) > c.config.MaxSize && c.fileFrames > 0 {
+		err := c.rotate()
+		if err != nil {
+			log.Printf("failed rotating capture file, stopping capture, err: %s", err)
+
+			c.closed = true
+
+			close(c.done)
+
+			return
+		}
+	}
+
+	c.writeBlock(pcapngBlockEPB, encodeEPB(c.memberID(member), now, direction, frame))
+
+	c.frames++
+	c.fileFrames++
+}
+
+func (c *capture) flushPeriodically() {
+	ticker := time.NewTicker(captureFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+
+		if !c.closed {
+			err := c.writer.Flush()
+			if err != nil {
+				log.Printf("failed writing capture file, err: %s", err)
+			}
+		}
+
+		c.mu.Unlock()
+	}
+}
+
+func (c *capture) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+
+	close(c.done)
+
+	return c.closeFile()
+}
+
+// captureStatus is the state of a segment's capture as reported by the api.
+type captureStatus struct {
+	Capture
+	File    string   `json:"file"`
+	Files   []string `json:"files"`
+	Members []string `json:"members"`
+	Frames  uint64   `json:"frames"`
+}
+
+func (c *capture) status() captureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return captureStatus{
+		Capture: c.config,
+		File:    c.files[len(c.files)-1],
+		Files:   append([]string(nil), c.files...),
+		Members: append([]string{}, c.members...),
+		Frames:  c.frames,
+	}
+}
+
+// pcapngAlign returns l rounded up to the 32 bit alignment of pcapng blocks and options.
+func pcapngAlign(l int) int {
+	return (l + 3) &^ 3 //nolint:gomnd
+}
+
+func pcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.NativeEndian.AppendUint16(b, code)
+	b = binary.NativeEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+
+	return append(b, make([]byte, pcapngAlign(len(value))-len(value))...)
+}
+
+func pcapngOptionsEnd(b []byte) []byte {
+	return binary.NativeEndian.AppendUint32(b, pcapngOptEnd)
+}
+
+func encodeSHB() []byte {
+	b := binary.NativeEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	b = binary.NativeEndian.AppendUint16(b, 1)
+	b = binary.NativeEndian.AppendUint16(b, 0)
+	// section length is unknown
+	b = binary.NativeEndian.AppendUint64(b, ^uint64(0))
+	b = pcapngOption(b, pcapngOptComment, []byte("slurpeeth "+Version))
+
+	return pcapngOptionsEnd(b)
+}
+
+func encodeIDB(name string) []byte {
+	b := binary.NativeEndian.AppendUint16(nil, pcapngLinkTypeEthernet)
+	b = binary.NativeEndian.AppendUint16(b, 0)
+	// no snaplen
+	b = binary.NativeEndian.AppendUint32(b, 0)
+	b = pcapngOption(b, pcapngOptIfName, []byte(name))
+
+	return pcapngOptionsEnd(b)
+}
+
+func encodeEPB(id uint32, ts time.Time, direction uint32, frame Bytes) []byte {
+	// default interface timestamp resolution is microseconds
+	micros := uint64(ts.UnixMicro())
+
+	b := binary.NativeEndian.AppendUint32(nil, id)
+	b = binary.NativeEndian.AppendUint32(b, uint32(micros>>32)) //nolint:gomnd
+	b = binary.NativeEndian.AppendUint32(b, uint32(micros))
+	b = binary.NativeEndian.AppendUint32(b, uint32(len(frame)))
+	b = binary.NativeEndian.AppendUint32(b, uint32(len(frame)))
+	b = append(b, frame...)
+	b = append(b, make([]byte, pcapngAlign(len(frame))-len(frame))...)
+	b = pcapngOption(b, pcapngOptEPBFlags, binary.NativeEndian.AppendUint32(nil, direction))
+
+	return pcapngOptionsEnd(b)
+}
+
+// startCapture starts capturing the worker's frames per config, replacing any running capture.
+func (w *Worker) startCapture(config Capture) error {
+	c, err := newCapture(config)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("capturing tunnel id %d to %q", w.segment.ID, config.Path)
+
+	old := w.capture.Swap(c)
+	if old != nil {
+		_ = old.close()
+	}
+
+	return nil
+}
+
+// stopCapture stops the worker's capture, returns false if it was not capturing.
+func (w *Worker) stopCapture() bool {
+	c := w.capture.Swap(nil)
+	if c == nil {
+		return false
+	}
+
+	err := c.close()
+	if err != nil {
+		log.Printf("failed closing capture for tunnel id %d, err: %s", w.segment.ID, err)
+	}
+
+	log.Printf("stopped capturing tunnel id %d", w.segment.ID)
+
+	return true
+}
+
+// captureFrame captures frame as seen on member in direction, if the worker is capturing.
+func (w *Worker) captureFrame(member func() string, direction uint32, frame Bytes) {
+	c := w.capture.Load()
+	if c == nil {
+		return
+	}
+
+	c.write(member(), direction, frame)
+}
+
+func (w *Worker) captureInterface(idx int, direction uint32, frame Bytes) {
+	w.captureFrame(func() string {
+		return "interface " + w.interfaces[idx].name
+	}, direction, frame)
+}
+
+func (w *Worker) captureDestination(idx int, msg *Message) {
+	if msg.Header.Type != MessageTypeData {
+		return
+	}
+
+	w.captureFrame(func() string {
+		return "destination " + w.destinations[idx].name
+	}, captureOutbound, msg.Body)
+}
+
+func (w *Worker) captureRemote(msg *Message) {
+	w.captureFrame(func() string {
+		member := "remote " + msg.Header.Sender
+
+		tcpAddr, ok := msg.remote.(*net.TCPAddr)
+		if ok {
+			member += " " + tcpAddr.IP.String()
+		}
+
+		return member
+	}, captureInbound, msg.Body)
+}
@@ -0,0 +1,184 @@
+package slurpeeth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialCommand starts the given command (via /bin/sh, the same as OpenSSH's ProxyCommand) and
+// returns a net.Conn that reads from the command's stdout and writes to its stdin. As with
+// ProxyCommand, "%h" and "%p" in the command are replaced by the destination address and the
+// slurpeeth port -- unlike ProxyCommand the values are shell quoted, so they are always a single
+// word. A command that exits within commandStartupTime (failed ssh auth, unreachable jump host and
+// the like) is a failed dial, so the usual dial retry backoff applies.
+func dialCommand(command, address string, port uint16) (net.Conn, error) {
+	command = strings.NewReplacer(
+		"%h", shellQuote(address),
+		"%p", shellQuote(strconv.Itoa(int(port))),
+		"%%", "%",
+	).Replace(command)
+
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		_ = stdinReader.Close()
+		_ = stdinWriter.Close()
+
+		return nil, err
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command) //nolint: gosec
+	cmd.Stdin = stdinReader
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Start()
+
+	// the child has its own copies of these now (or failed to start), either way we are done
+	// with our copies of the child's ends of the pipes
+	_ = stdinReader.Close()
+	_ = stdoutWriter.Close()
+
+	if err != nil {
+		_ = stdinWriter.Close()
+		_ = stdoutReader.Close()
+
+		return nil, fmt.Errorf(
+			"%w: failed starting command %q, error: %w", ErrConnectivity, command, err,
+		)
+	}
+
+	c := &commandConn{
+		command: command,
+		cmd:     cmd,
+		stdin:   stdinWriter,
+		stdout:  stdoutReader,
+		done:    make(chan struct{}),
+	}
+
+	go c.wait()
+
+	select {
+	case <-c.done:
+		_ = c.stdin.Close()
+
+		if c.waitErr != nil {
+			return nil, fmt.Errorf(
+				"%w: command %q exited right after starting, error: %w",
+				ErrConnectivity, command, c.waitErr,
+			)
+		}
+
+		return nil, fmt.Errorf(
+			"%w: command %q exited right after starting", ErrConnectivity, command,
+		)
+	case <-time.After(commandStartupTime):
+	}
+
+	return c, nil
+}
+
+// shellQuote quotes s as a single word for /bin/sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// commandConn is a net.Conn backed by the stdin/stdout of a child process.
+type commandConn struct {
+	command string
+	cmd     *exec.Cmd
+	stdin   *os.File
+	stdout  *os.File
+	done    chan struct{}
+	waitErr error
+}
+
+func (c *commandConn) wait() {
+	c.waitErr = c.cmd.Wait()
+
+	if c.waitErr != nil {
+		log.Printf("command %q exited, err: %s", c.command, c.waitErr)
+	} else {
+		log.Printf("command %q exited", c.command)
+	}
+
+	// closing the read side of stdout wakes up anything blocked reading from the conn, they'll
+	// get an error and the normal destination error handling takes over
+	_ = c.stdout.Close()
+
+	close(c.done)
+}
+
+func (c *commandConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *commandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+// Close closes the stdin of the child process and kills it if it has not exited shortly after.
+func (c *commandConn) Close() error {
+	stdinErr := c.stdin.Close()
+
+	select {
+	case <-c.done:
+	case <-time.After(commandExitGracePeriod):
+		_ = c.cmd.Process.Kill()
+
+		<-c.done
+	}
+
+	if stdinErr != nil && !errors.Is(stdinErr, os.ErrClosed) {
+		return stdinErr
+	}
+
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr {
+	return commandAddr(c.command)
+}
+
+func (c *commandConn) RemoteAddr() net.Addr {
+	return commandAddr(c.command)
+}
+
+func (c *commandConn) SetDeadline(t time.Time) error {
+	err := c.stdin.SetWriteDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *commandConn) SetReadDeadline(t time.Time) error {
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *commandConn) SetWriteDeadline(t time.Time) error {
+	return c.stdin.SetWriteDeadline(t)
+}
+
+// commandAddr is the net.Addr of a commandConn, it is just the command that was executed.
+type commandAddr string
+
+func (a commandAddr) Network() string {
+	return "command"
+}
+
+func (a commandAddr) String() string {
+	return string(a)
+}
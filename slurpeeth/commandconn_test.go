@@ -0,0 +1,80 @@
+package slurpeeth
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDialCommandRoundTrip(t *testing.T) {
+	conn, err := dialCommand("cat", "", Port)
+	if err != nil {
+		t.Fatalf("failed dialing command, err: %s", err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	sent := NewMessageFromBody(10, "0123456789", Bytes("some frame"))
+
+	_, err = conn.Write(sent.Output())
+	if err != nil {
+		t.Fatalf("failed writing message, err: %s", err)
+	}
+
+	received, err := NewMessageFromConn(conn)
+	if err != nil {
+		t.Fatalf("failed reading message, err: %s", err)
+	}
+
+	if received.Header.ID != sent.Header.ID || received.Header.Sender != sent.Header.Sender {
+		t.Fatalf("expected header %+v, got %+v", sent.Header, received.Header)
+	}
+
+	if !bytes.Equal(received.Body, sent.Body) {
+		t.Fatalf("expected body %q, got %q", sent.Body, received.Body)
+	}
+}
+
+func TestDialCommandEarlyExit(t *testing.T) {
+	for _, command := range []string{"exit 0", "exit 255", "/does/not/exist"} {
+		t.Run(command, func(t *testing.T) {
+			conn, err := dialCommand(command, "", Port)
+			if err == nil {
+				_ = conn.Close()
+
+				t.Fatal("expected an error for a command that exits right away")
+			}
+
+			if !errors.Is(err, ErrConnectivity) {
+				t.Fatalf("expected ErrConnectivity, got %s", err)
+			}
+		})
+	}
+}
+
+func TestDialCommandQuotesSubstitutions(t *testing.T) {
+	address := `host'; echo injected; '$(echo injected)`
+
+	conn, err := dialCommand("printf %%s %h; cat", address, Port)
+	if err != nil {
+		t.Fatalf("failed dialing command, err: %s", err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	got := make([]byte, len(address))
+
+	_, err = io.ReadFull(conn, got)
+	if err != nil {
+		t.Fatalf("failed reading command output, err: %s", err)
+	}
+
+	if string(got) != address {
+		t.Fatalf("expected the address %q verbatim, got %q", address, got)
+	}
+}
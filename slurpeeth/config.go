@@ -82,7 +82,9 @@ func (m *manager) reloadConfig() {
 
 	log.Print("deleting old workers...")
 
+	m.workersLock.Lock()
 	m.workers = make(map[uint16]*Worker)
+	m.workersLock.Unlock()
 
 	log.Print("rebuilding workers...")
 
@@ -18,6 +18,18 @@ const (
 	// TCP is a const for... TCP!
 	TCP = "tcp"
 
+	// InterfaceCreateTap is the Interface.Create value that tells slurpeeth to create a tap device.
+	InterfaceCreateTap = "tap"
+
+	// InterfaceCreateVeth is the Interface.Create value that tells slurpeeth to create a veth pair.
+	InterfaceCreateVeth = "veth"
+
+	// TunDevicePath is the path to the tun/tap clone device.
+	TunDevicePath = "/dev/net/tun"
+
+	// NetnsRunDir is the directory named network namespaces live in (as created by "ip netns").
+	NetnsRunDir = "/var/run/netns"
+
 	// Address is the default Slurpeeth listen address.
 	Address = "0.0.0.0"
 
@@ -36,8 +48,113 @@ const (
 	// VlanTagSize is the size of a byte slice holding dot1q tag info.
 	VlanTagSize = 4
 
+	// SegmentModeHub is the Segment.Mode value for flooding every frame to every member (the
+	// default).
+	SegmentModeHub = "hub"
+
+	// SegmentModeSwitch is the Segment.Mode value for mac learning.
+	SegmentModeSwitch = "switch"
+
+	// MACAgeTime is the default time learned macs are kept for segments in switch mode.
+	MACAgeTime = 5 * time.Minute
+
+	// ShapingDropTail is the Shaping.Drop value for dropping frames when the queue is full (the
+	// default).
+	ShapingDropTail = "tail"
+
+	// ShapingDropRED is the Shaping.Drop value for random early detection.
+	ShapingDropRED = "red"
+
+	// ShapingQueueLimit is the default queue limit (in frames) of shaped segments, the same as
+	// the default txqueuelen of most interfaces.
+	ShapingQueueLimit = 1000
+
+	// DestinationQueueSize is the number of messages queued for each destination (stream), messages
+	// are dropped when the queue is full -- like when the destination is not connected.
+	DestinationQueueSize = 1000
+
+	// StormControlActionDrop is the StormControl.Action value for dropping frames over the
+	// threshold (the default).
+	StormControlActionDrop = "drop"
+
+	// StormControlActionErrDisable is the StormControl.Action value for pausing the segment when
+	// a threshold is exceeded.
+	StormControlActionErrDisable = "err-disable"
+
+	// ScenarioActionImpair is the ScenarioEvent.Action value for setting an impairment.
+	ScenarioActionImpair = "impair"
+
+	// ScenarioActionClear is the ScenarioEvent.Action value for clearing impairments.
+	ScenarioActionClear = "clear"
+
+	// ScenarioActionDown is the ScenarioEvent.Action value for pausing a segment.
+	ScenarioActionDown = "down"
+
+	// ScenarioActionUp is the ScenarioEvent.Action value for resuming a segment.
+	ScenarioActionUp = "up"
+
+	// LinkDownCarrier is the link down mode that clears the carrier of a segment's interfaces.
+	LinkDownCarrier = "carrier"
+
+	// LinkDownAdmin is the link down mode that sets a segment's interfaces administratively down.
+	LinkDownAdmin = "admin"
+
+	// InterfaceBackendPacket is the Interface.Backend value for a plain AF_PACKET socket (the
+	// default).
+	InterfaceBackendPacket = "packet"
+
+	// InterfaceBackendRing is the Interface.Backend value for an AF_PACKET socket using TPACKET_V3
+	// mmap'd rx/tx rings.
+	InterfaceBackendRing = "ring"
+
+	// InterfaceBackendXDP is the Interface.Backend value for AF_XDP sockets.
+	InterfaceBackendXDP = "xdp"
+
+	// RingRxBlockSize is the size of each block in a packet ring's rx ring, this must be a multiple
+	// of the page size.
+	RingRxBlockSize = 1 << 18
+
+	// RingRxBlockCount is the number of blocks in a packet ring's rx ring.
+	RingRxBlockCount = 16
+
+	// RingRxFrameSize is the nominal frame size of a packet ring's rx ring -- with TPACKET_V3
+	// frames are variable length within a block so this only matters to the kernel's sanity
+	// checks.
+	RingRxFrameSize = 1 << 11
+
+	// RingRxBlockTimeoutMs is how long the kernel waits before handing a partially filled rx block
+	// to us.
+	RingRxBlockTimeoutMs = 1
+
+	// RingTxBlockSize is the size of each block in a packet ring's tx ring.
+	RingTxBlockSize = 1 << 16
+
+	// RingTxBlockCount is the number of blocks in a packet ring's tx ring.
+	RingTxBlockCount = 16
+
+	// RingTxFrameSize is the size of each frame slot in a packet ring's tx ring, this must fit the
+	// largest frame we'll send plus the tpacket header.
+	RingTxFrameSize = 1 << 14
+
+	// RingPollTimeoutMs is the timeout for polling a packet ring (or af_xdp socket), this bounds
+	// how long it takes for a reader to notice the ring was closed.
+	RingPollTimeoutMs = 100
+
+	// XDPFrameSize is the size of each frame in an af_xdp umem, this caps the size of frames an
+	// af_xdp interface can send/receive.
+	XDPFrameSize = 1 << 12
+
+	// XDPFrameCount is the number of frames in each af_xdp umem, half are used for receiving, half
+	// for transmitting.
+	XDPFrameCount = 1 << 12
+
+	// XDPRingSize is the number of entries in each af_xdp ring, this must be a power of two and
+	// at least XDPFrameCount / 2.
+	XDPRingSize = XDPFrameCount / 2
+
 	// MessageHeaderSize is the size of the "header" we prepend to messages sent from a Sender --
-	// this header contains the tunnel ID, size of the message, and some reserved space.
+	// this header contains the tunnel ID, size of the message, the sender, the message type, and
+	// some reserved space.
 	MessageHeaderSize = 32
 )
 
@@ -45,4 +162,7 @@ const (
 	dialRetryDelay           = 500 * time.Millisecond
 	shutdownCheckDelay       = 10 * time.Millisecond
 	maxDialRetrySleepSeconds = 60
+	commandExitGracePeriod   = time.Second
+	commandStartupTime       = time.Second
+	netnsPollInterval        = time.Second
 )
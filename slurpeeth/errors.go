@@ -14,3 +14,6 @@ var ErrMessage = errors.New("errMessage")
 
 // ErrBind is a generic error for bind issues -- like finding a requested interface.
 var ErrBind = errors.New("errBind")
+
+// ErrConfig is a generic error for invalid configuration -- for example, negative buffer sizes.
+var ErrConfig = errors.New("errConfig")
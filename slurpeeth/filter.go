@@ -0,0 +1,694 @@
+package slurpeeth
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	etherTypeARP  = 0x0806
+	etherTypeLLDP = 0x88cc
+
+	ipProtoICMP   = 1
+	ipProtoICMPv6 = 58
+
+	// bpfAccept is the (snap) length returned by filters for frames that match -- the same value
+	// tcpdump uses, which is larger than any frame we will ever see.
+	bpfAccept = 0x40000
+
+	// bpfMaxJump is the furthest a classic bpf conditional jump can go.
+	bpfMaxJump = 0xff
+
+	// bpfMaxInstructions is the most instructions the kernel accepts in a classic bpf program
+	// (BPF_MAXINSNS).
+	bpfMaxInstructions = 4096
+
+	// skfAdOff and friends are the "ancillary data" offsets (SKF_AD_*) from linux/filter.h, they
+	// are not in x/sys/unix. Loads from these offsets read skb metadata rather than frame bytes
+	// -- which is the only way to see vlan tags the kernel already stripped from the frame.
+	skfAdOff             = -0x1000
+	skfAdVlanTag         = 44
+	skfAdVlanTagPresent  = 48
+	vlanIDMask           = 0x0fff
+	ipv4ProtocolOffset   = ethernetHeaderSize + 9
+	ipv6NextHeaderOffset = ethernetHeaderSize + 6
+
+	// vlanStrippedScratch is the scratch memory slot set once a vlan primitive matched the tag
+	// the kernel stripped, so that the next vlan primitive looks at the tags left in the frame.
+	vlanStrippedScratch = 0
+)
+
+//nolint:gochecknoglobals
+var (
+	filterEtherTypes = map[string]uint32{
+		"ip":   etherTypeIPv4,
+		"ip6":  etherTypeIPv6,
+		"arp":  etherTypeARP,
+		"lldp": etherTypeLLDP,
+	}
+
+	filterIPProtocols = map[string]uint32{
+		"icmp":  ipProtoICMP,
+		"tcp":   ipProtoTCP,
+		"udp":   ipProtoUDP,
+		"icmp6": ipProtoICMPv6,
+		"sctp":  ipProtoSCTP,
+	}
+)
+
+func attachSocketFilter(fd int, program []unix.SockFilter) error {
+	return unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(program)),
+		Filter: &program[0],
+	})
+}
+
+// compileFilter returns the classic bpf program for the filter -- either the raw instructions as
+// given, or the compiled expression.
+func compileFilter(filter *Filter) ([]unix.SockFilter, error) {
+	if filter.Expression != "" && len(filter.Instructions) > 0 {
+		return nil, fmt.Errorf(
+			"%w: filter can have an expression or instructions, not both", ErrConfig,
+		)
+	}
+
+	if filter.Expression != "" {
+		return compileFilterExpression(filter.Expression)
+	}
+
+	program := make([]unix.SockFilter, len(filter.Instructions))
+
+	for idx, insn := range filter.Instructions {
+		if len(insn) != 4 { //nolint:gomnd
+			return nil, fmt.Errorf(
+				"%w: filter instruction %d should be [code, jt, jf, k], got %v",
+				ErrConfig,
+				idx,
+				insn,
+			)
+		}
+
+		program[idx] = unix.SockFilter{
+			Code: uint16(insn[0]),
+			Jt:   uint8(insn[1]),
+			Jf:   uint8(insn[2]),
+			K:    insn[3],
+		}
+	}
+
+	if len(program) == 0 {
+		return nil, fmt.Errorf("%w: filter has no expression or instructions", ErrConfig)
+	}
+
+	return program, nil
+}
+
+// compileFilterExpression compiles a filter expression into a classic bpf program that returns
+// bpfAccept for frames matching the expression and 0 (drop) for everything else. The expression
+// language is a small tcpdump-like subset:
+//
+//	ether proto <n|ip|ip6|arp|lldp>, ether src|dst|host <mac>,
+//	vlan [id], ip proto <n|icmp|tcp|udp|icmp6|sctp>,
+//	ip, ip6, arp, lldp, icmp, tcp, udp, icmp6, sctp,
+//	and (&&), or (||), not (!), and parentheses.
+//
+// As with tcpdump, a vlan primitive that matches a tag still in the frame moves the offsets of
+// everything after it in the expression past the tag -- so "vlan 10 and ip" matches ip in vlan 10
+// whether or not the kernel stripped the tag (the X register holds the offset at runtime).
+func compileFilterExpression(expression string) ([]unix.SockFilter, error) {
+	p := &filterParser{tokens: tokenizeFilter(expression)}
+
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid filter %q, error: %w", ErrConfig, expression, err)
+	}
+
+	if !p.done() {
+		return nil, fmt.Errorf(
+			"%w: invalid filter %q, unexpected %q", ErrConfig, expression, p.peek(),
+		)
+	}
+
+	c := &filterCompiler{}
+
+	accept := c.newLabel()
+	reject := c.newLabel()
+
+	// no vlan matched yet, and nothing to skip
+	c.emit(unix.SockFilter{Code: unix.BPF_LD | unix.BPF_IMM})
+	c.emit(unix.SockFilter{Code: unix.BPF_ST, K: vlanStrippedScratch})
+	c.emit(unix.SockFilter{Code: unix.BPF_LDX | unix.BPF_IMM})
+
+	node.compile(c, accept, reject)
+
+	c.place(accept)
+	c.emit(unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: bpfAccept})
+	c.place(reject)
+	c.emit(unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K})
+
+	program, err := c.resolve()
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid filter %q, error: %w", ErrConfig, expression, err)
+	}
+
+	return program, nil
+}
+
+func tokenizeFilter(expression string) []string {
+	expression = strings.NewReplacer(
+		"(", " ( ", ")", " ) ", "&&", " and ", "||", " or ", "!", " not ",
+	).Replace(expression)
+
+	return strings.Fields(strings.ToLower(expression))
+}
+
+// filterNode is a node in a parsed filter expression, compile emits the code that jumps to
+// trueLabel if the node matches and falseLabel otherwise.
+type filterNode interface {
+	compile(c *filterCompiler, trueLabel, falseLabel int)
+}
+
+type filterAnd struct{ left, right filterNode }
+
+func (n filterAnd) compile(c *filterCompiler, trueLabel, falseLabel int) {
+	next := c.newLabel()
+
+	n.left.compile(c, next, falseLabel)
+	c.place(next)
+	n.right.compile(c, trueLabel, falseLabel)
+}
+
+type filterOr struct{ left, right filterNode }
+
+func (n filterOr) compile(c *filterCompiler, trueLabel, falseLabel int) {
+	next := c.newLabel()
+
+	n.left.compile(c, trueLabel, next)
+	c.place(next)
+	n.right.compile(c, trueLabel, falseLabel)
+}
+
+type filterNot struct{ node filterNode }
+
+func (n filterNot) compile(c *filterCompiler, trueLabel, falseLabel int) {
+	n.node.compile(c, falseLabel, trueLabel)
+}
+
+// filterMatch loads a value (from the frame or from skb ancillary data), optionally masks it, and
+// compares it to value.
+type filterMatch struct {
+	load  unix.SockFilter
+	mask  uint32
+	value uint32
+}
+
+func (n filterMatch) compile(c *filterCompiler, trueLabel, falseLabel int) {
+	c.emit(n.load)
+
+	if n.mask != 0 {
+		c.emit(unix.SockFilter{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: n.mask})
+	}
+
+	c.emitJump(
+		unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: n.value},
+		trueLabel,
+		falseLabel,
+	)
+}
+
+func loadAbsolute(size uint16, offset int) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_LD | size | unix.BPF_ABS, K: uint32(int32(offset))}
+}
+
+// loadIndirect loads from offset past the vlan tags matched so far (the X register).
+func loadIndirect(size uint16, offset int) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_LD | size | unix.BPF_IND, K: uint32(offset)}
+}
+
+func matchEtherType(etherType uint32) filterNode {
+	return filterMatch{load: loadIndirect(unix.BPF_H, 12), value: etherType} //nolint:gomnd
+}
+
+func matchMAC(offset int, mac net.HardwareAddr) filterNode {
+	return filterAnd{
+		left: filterMatch{
+			load:  loadAbsolute(unix.BPF_W, offset),
+			value: uint32(mac[0])<<24 | uint32(mac[1])<<16 | uint32(mac[2])<<8 | uint32(mac[3]),
+		},
+		right: filterMatch{
+			load:  loadAbsolute(unix.BPF_H, offset+4), //nolint:gomnd
+			value: uint32(mac[4])<<8 | uint32(mac[5]),
+		},
+	}
+}
+
+func matchIPProtocol(protocol uint32) filterNode {
+	return filterOr{
+		left: filterAnd{
+			left: matchEtherType(etherTypeIPv4),
+			right: filterMatch{
+				load: loadIndirect(unix.BPF_B, ipv4ProtocolOffset), value: protocol,
+			},
+		},
+		right: filterAnd{
+			left: matchEtherType(etherTypeIPv6),
+			right: filterMatch{
+				load: loadIndirect(unix.BPF_B, ipv6NextHeaderOffset), value: protocol,
+			},
+		},
+	}
+}
+
+// matchVlan matches frames with a vlan tag (with the given id if id >= 0). If the kernel stripped
+// a tag into skb metadata that is the outermost tag, so it is what the first vlan primitive
+// matches -- vlan primitives after that (or all of them, if nothing was stripped) match the next
+// tag still in the frame.
+func matchVlan(id int) filterNode {
+	return filterVlan{id: id}
+}
+
+type filterVlan struct{ id int }
+
+func (n filterVlan) compile(c *filterCompiler, trueLabel, falseLabel int) {
+	stripped := c.newLabel()
+	inFrame := c.newLabel()
+
+	// the stripped tag applies if there is one and no earlier vlan primitive matched it already
+	filterAnd{
+		left: filterMatch{
+			load: unix.SockFilter{Code: unix.BPF_LD | unix.BPF_MEM, K: vlanStrippedScratch},
+		},
+		right: filterNot{
+			node: filterMatch{load: loadAbsolute(unix.BPF_W, skfAdOff+skfAdVlanTagPresent)},
+		},
+	}.compile(c, stripped, inFrame)
+
+	c.place(stripped)
+	filterVlanStripped(n).compile(c, trueLabel, falseLabel)
+	c.place(inFrame)
+	filterVlanInFrame(n).compile(c, trueLabel, falseLabel)
+}
+
+// filterVlanStripped matches the tag the kernel stripped into skb metadata, and marks it as
+// matched so vlan primitives after it look at the tags left in the frame.
+type filterVlanStripped struct{ id int }
+
+func (n filterVlanStripped) compile(c *filterCompiler, trueLabel, falseLabel int) {
+	if n.id >= 0 {
+		matched := c.newLabel()
+
+		filterMatch{
+			load:  loadAbsolute(unix.BPF_W, skfAdOff+skfAdVlanTag),
+			mask:  vlanIDMask,
+			value: uint32(n.id),
+		}.compile(c, matched, falseLabel)
+
+		c.place(matched)
+	}
+
+	c.emit(unix.SockFilter{Code: unix.BPF_LD | unix.BPF_IMM, K: 1})
+	c.emit(unix.SockFilter{Code: unix.BPF_ST, K: vlanStrippedScratch})
+	c.emitGoto(trueLabel)
+}
+
+// filterVlanInFrame matches the next tag in the frame, and moves the offsets of everything after
+// it past the tag.
+type filterVlanInFrame struct{ id int }
+
+func (n filterVlanInFrame) compile(c *filterCompiler, trueLabel, falseLabel int) {
+	var node filterNode = filterOr{
+		left:  matchEtherType(etherTypeDot1Q),
+		right: matchEtherType(etherTypeDot1AD),
+	}
+
+	if n.id >= 0 {
+		node = filterAnd{
+			left: node,
+			right: filterMatch{
+				load:  loadIndirect(unix.BPF_H, ethernetHeaderSize),
+				mask:  vlanIDMask,
+				value: uint32(n.id),
+			},
+		}
+	}
+
+	matched := c.newLabel()
+
+	node.compile(c, matched, falseLabel)
+
+	c.place(matched)
+	c.emit(unix.SockFilter{Code: unix.BPF_MISC | unix.BPF_TXA})
+	c.emit(unix.SockFilter{Code: unix.BPF_ALU | unix.BPF_ADD | unix.BPF_K, K: VlanTagSize})
+	c.emit(unix.SockFilter{Code: unix.BPF_MISC | unix.BPF_TAX})
+	c.emitGoto(trueLabel)
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *filterParser) peek() string {
+	if p.done() {
+		return ""
+	}
+
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.done() {
+		return "", fmt.Errorf("%w: unexpected end of filter", ErrConfig)
+	}
+
+	p.pos++
+
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "or" {
+		p.pos++
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = filterOr{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "and" {
+		p.pos++
+
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		left = filterAnd{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	token, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case "not":
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		return filterNot{node: node}, nil
+	case "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		token, err = p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if token != ")" {
+			return nil, fmt.Errorf("%w: expected \")\", got %q", ErrConfig, token)
+		}
+
+		return node, nil
+	default:
+		return p.parsePrimitive(token)
+	}
+}
+
+func (p *filterParser) parsePrimitive(token string) (filterNode, error) {
+	if etherType, ok := filterEtherTypes[token]; ok {
+		if token == "ip" && p.peek() == "proto" {
+			p.pos++
+
+			protocol, err := p.parseValue(filterIPProtocols, 0xff) //nolint:gomnd
+			if err != nil {
+				return nil, err
+			}
+
+			return matchIPProtocol(protocol), nil
+		}
+
+		return matchEtherType(etherType), nil
+	}
+
+	if protocol, ok := filterIPProtocols[token]; ok {
+		return matchIPProtocol(protocol), nil
+	}
+
+	switch token {
+	case "ether":
+		return p.parseEther()
+	case "vlan":
+		id, err := strconv.ParseUint(p.peek(), 0, 12) //nolint:gomnd
+		if err != nil {
+			// no (valid) id, so any vlan
+			return matchVlan(-1), nil
+		}
+
+		p.pos++
+
+		return matchVlan(int(id)), nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown filter primitive %q", ErrConfig, token)
+}
+
+func (p *filterParser) parseEther() (filterNode, error) {
+	qualifier, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if qualifier == "proto" {
+		etherType, err := p.parseValue(filterEtherTypes, 0xffff) //nolint:gomnd
+		if err != nil {
+			return nil, err
+		}
+
+		return matchEtherType(etherType), nil
+	}
+
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := net.ParseMAC(value)
+	if err != nil || len(mac) != 6 { //nolint:gomnd
+		return nil, fmt.Errorf("%w: invalid mac %q", ErrConfig, value)
+	}
+
+	switch qualifier {
+	case "src":
+		return matchMAC(6, mac), nil //nolint:gomnd
+	case "dst":
+		return matchMAC(0, mac), nil
+	case "host":
+		return filterOr{left: matchMAC(0, mac), right: matchMAC(6, mac)}, nil //nolint:gomnd
+	}
+
+	return nil, fmt.Errorf("%w: unknown ether qualifier %q", ErrConfig, qualifier)
+}
+
+// parseValue parses the next token as either a name in names or a number no larger than maxValue.
+func (p *filterParser) parseValue(names map[string]uint32, maxValue uint64) (uint32, error) {
+	token, err := p.next()
+	if err != nil {
+		return 0, err
+	}
+
+	if value, ok := names[token]; ok {
+		return value, nil
+	}
+
+	value, err := strconv.ParseUint(token, 0, 32)
+	if err != nil || value > maxValue {
+		return 0, fmt.Errorf("%w: invalid value %q", ErrConfig, token)
+	}
+
+	return uint32(value), nil
+}
+
+// filterCompiler emits instructions with symbolic jump targets (labels) that are resolved to
+// relative offsets once the whole program is emitted.
+type filterCompiler struct {
+	insns  []unix.SockFilter
+	jumps  map[int][2]int
+	gotos  map[int]int
+	labels []int
+}
+
+func (c *filterCompiler) newLabel() int {
+	c.labels = append(c.labels, -1)
+
+	return len(c.labels) - 1
+}
+
+func (c *filterCompiler) place(label int) {
+	c.labels[label] = len(c.insns)
+}
+
+func (c *filterCompiler) emit(insn unix.SockFilter) {
+	c.insns = append(c.insns, insn)
+}
+
+func (c *filterCompiler) emitJump(insn unix.SockFilter, trueLabel, falseLabel int) {
+	if c.jumps == nil {
+		c.jumps = map[int][2]int{}
+	}
+
+	c.jumps[len(c.insns)] = [2]int{trueLabel, falseLabel}
+
+	c.emit(insn)
+}
+
+// emitGoto emits an unconditional jump to label.
+func (c *filterCompiler) emitGoto(label int) {
+	if c.gotos == nil {
+		c.gotos = map[int]int{}
+	}
+
+	c.gotos[len(c.insns)] = label
+
+	c.emit(unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JA})
+}
+
+// resolve turns the jump labels into relative offsets. A conditional jump can only skip
+// bpfMaxJump instructions, so a branch that has to go further goes to an unconditional jump
+// (which can go anywhere) inserted right after it instead. Inserting moves everything after the
+// insertion, possibly out of range of other jumps, so this repeats until every jump fits.
+func (c *filterCompiler) resolve() ([]unix.SockFilter, error) {
+	for c.insertTrampolines() { //nolint:revive
+		// until every conditional jump is in range
+	}
+
+	if len(c.insns) > bpfMaxInstructions {
+		return nil, fmt.Errorf(
+			"%w: filter too large, %d instructions (max %d)",
+			ErrConfig,
+			len(c.insns),
+			bpfMaxInstructions,
+		)
+	}
+
+	for pc, label := range c.gotos {
+		// labels are only ever placed after the jumps to them
+		c.insns[pc].K = uint32(c.labels[label] - pc - 1)
+	}
+
+	for pc, labels := range c.jumps {
+		c.insns[pc].Jt = uint8(c.labels[labels[0]] - pc - 1)
+		c.insns[pc].Jf = uint8(c.labels[labels[1]] - pc - 1)
+	}
+
+	return c.insns, nil
+}
+
+// insertTrampolines inserts an unconditional jump after each conditional jump for each of its
+// branches that is out of range, returning false if there were none.
+func (c *filterCompiler) insertTrampolines() bool {
+	// the out of range branches by the pc of their jump
+	far := map[int][]int{}
+
+	for pc, labels := range c.jumps {
+		for branch, label := range labels {
+			if c.labels[label]-pc-1 > bpfMaxJump {
+				far[pc] = append(far[pc], branch)
+			}
+		}
+	}
+
+	if len(far) == 0 {
+		return false
+	}
+
+	// where each instruction moves to, trampolines go right after their jump
+	moved := make([]int, len(c.insns)+1)
+
+	var shift int
+
+	for pc := range moved {
+		moved[pc] = pc + shift
+		shift += len(far[pc])
+	}
+
+	for label, at := range c.labels {
+		c.labels[label] = moved[at]
+	}
+
+	jumps := make(map[int][2]int, len(c.jumps))
+
+	for pc, labels := range c.jumps {
+		jumps[moved[pc]] = labels
+	}
+
+	gotos := make(map[int]int, len(c.gotos)+shift)
+
+	for pc, label := range c.gotos {
+		gotos[moved[pc]] = label
+	}
+
+	insns := make([]unix.SockFilter, 0, len(c.insns)+shift)
+
+	for pc, insn := range c.insns {
+		insns = append(insns, insn)
+
+		if len(far[pc]) == 0 {
+			continue
+		}
+
+		labels := jumps[moved[pc]]
+
+		for _, branch := range far[pc] {
+			trampoline := c.newLabel()
+			c.labels[trampoline] = len(insns)
+
+			gotos[len(insns)] = labels[branch]
+			labels[branch] = trampoline
+
+			insns = append(insns, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JA})
+		}
+
+		jumps[moved[pc]] = labels
+	}
+
+	c.insns = insns
+	c.jumps = jumps
+	c.gotos = gotos
+
+	return true
+}
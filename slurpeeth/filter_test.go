@@ -0,0 +1,423 @@
+package slurpeeth
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// runFilter runs a classic bpf program against frame the way the kernel would for a packet socket
+// and returns what the program returned, strippedTCI is the vlan tag the kernel stripped from the
+// frame (if any). Only the instructions the filter compiler emits are supported.
+func runFilter(t *testing.T, program []unix.SockFilter, frame []byte, strippedTCI *uint16) uint32 {
+	t.Helper()
+
+	var a, x uint32
+
+	var scratch [16]uint32
+
+	load := func(size uint16, offset int) (uint32, bool) {
+		if offset < 0 {
+			switch offset - skfAdOff {
+			case skfAdVlanTagPresent:
+				if strippedTCI != nil {
+					return 1, true
+				}
+
+				return 0, true
+			case skfAdVlanTag:
+				if strippedTCI != nil {
+					return uint32(*strippedTCI), true
+				}
+
+				return 0, true
+			}
+
+			t.Fatalf("unsupported ancillary load at offset %d", offset)
+		}
+
+		switch size {
+		case unix.BPF_W:
+			if offset+4 > len(frame) {
+				return 0, false
+			}
+
+			return binary.BigEndian.Uint32(frame[offset:]), true
+		case unix.BPF_H:
+			if offset+2 > len(frame) {
+				return 0, false
+			}
+
+			return uint32(binary.BigEndian.Uint16(frame[offset:])), true
+		default:
+			if offset+1 > len(frame) {
+				return 0, false
+			}
+
+			return uint32(frame[offset]), true
+		}
+	}
+
+	for pc := 0; pc < len(program); pc++ {
+		insn := program[pc]
+
+		switch {
+		case insn.Code == unix.BPF_RET|unix.BPF_K:
+			return insn.K
+		case insn.Code == unix.BPF_LD|unix.BPF_IMM:
+			a = insn.K
+		case insn.Code == unix.BPF_LDX|unix.BPF_IMM:
+			x = insn.K
+		case insn.Code == unix.BPF_LD|unix.BPF_MEM:
+			a = scratch[insn.K]
+		case insn.Code == unix.BPF_ST:
+			scratch[insn.K] = a
+		case insn.Code&^0x18 == unix.BPF_LD|unix.BPF_ABS:
+			var ok bool
+
+			a, ok = load(insn.Code&0x18, int(int32(insn.K)))
+			if !ok {
+				return 0
+			}
+		case insn.Code&^0x18 == unix.BPF_LD|unix.BPF_IND:
+			var ok bool
+
+			a, ok = load(insn.Code&0x18, int(x+insn.K))
+			if !ok {
+				return 0
+			}
+		case insn.Code == unix.BPF_ALU|unix.BPF_AND|unix.BPF_K:
+			a &= insn.K
+		case insn.Code == unix.BPF_ALU|unix.BPF_ADD|unix.BPF_K:
+			a += insn.K
+		case insn.Code == unix.BPF_MISC|unix.BPF_TAX:
+			x = a
+		case insn.Code == unix.BPF_MISC|unix.BPF_TXA:
+			a = x
+		case insn.Code == unix.BPF_JMP|unix.BPF_JA:
+			pc += int(insn.K)
+		case insn.Code == unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K:
+			if a == insn.K {
+				pc += int(insn.Jt)
+			} else {
+				pc += int(insn.Jf)
+			}
+		default:
+			t.Fatalf("unsupported instruction %+v at %d", insn, pc)
+		}
+	}
+
+	t.Fatalf("program fell off the end")
+
+	return 0
+}
+
+// testFrame builds a frame with the given vlan tags (tpid, tci pairs) in it, followed by
+// etherType and some payload.
+func testFrame(etherType uint16, tags ...uint16) []byte {
+	frame := []byte{2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1}
+
+	for _, tag := range tags {
+		frame = binary.BigEndian.AppendUint16(frame, tag)
+	}
+
+	frame = binary.BigEndian.AppendUint16(frame, etherType)
+
+	return append(frame, make([]byte, 46)...)
+}
+
+func TestCompileFilterExpressionProgram(t *testing.T) {
+	prologue := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_IMM},
+		{Code: unix.BPF_ST, K: vlanStrippedScratch},
+		{Code: unix.BPF_LDX | unix.BPF_IMM},
+	}
+
+	cases := []struct {
+		name       string
+		expression string
+		expected   []unix.SockFilter
+	}{
+		{
+			name:       "plain",
+			expression: "ip",
+			expected: append(prologue[:3:3], []unix.SockFilter{
+				{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_IND, K: 12},
+				{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 1, K: etherTypeIPv4},
+				{Code: unix.BPF_RET | unix.BPF_K, K: bpfAccept},
+				{Code: unix.BPF_RET | unix.BPF_K},
+			}...),
+		},
+		{
+			name:       "vlan",
+			expression: "vlan 10",
+			expected: append(prologue[:3:3], []unix.SockFilter{
+				// the stripped tag, if there is one and an earlier vlan primitive did not match it
+				{Code: unix.BPF_LD | unix.BPF_MEM, K: vlanStrippedScratch},
+				{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 8},
+				{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0xfffff030},
+				{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 6, Jf: 0},
+				{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0xfffff02c},
+				{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: vlanIDMask},
+				{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 15, K: 10},
+				{Code: unix.BPF_LD | unix.BPF_IMM, K: 1},
+				{Code: unix.BPF_ST, K: vlanStrippedScratch},
+				{Code: unix.BPF_JMP | unix.BPF_JA, K: 11},
+				// the next tag in the frame
+				{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_IND, K: 12},
+				{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 2, Jf: 0, K: etherTypeDot1Q},
+				{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_IND, K: 12},
+				{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 8, K: etherTypeDot1AD},
+				{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_IND, K: 14},
+				{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: vlanIDMask},
+				{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 5, K: 10},
+				{Code: unix.BPF_MISC | unix.BPF_TXA},
+				{Code: unix.BPF_ALU | unix.BPF_ADD | unix.BPF_K, K: VlanTagSize},
+				{Code: unix.BPF_MISC | unix.BPF_TAX},
+				{Code: unix.BPF_JMP | unix.BPF_JA, K: 0},
+				{Code: unix.BPF_RET | unix.BPF_K, K: bpfAccept},
+				{Code: unix.BPF_RET | unix.BPF_K},
+			}...),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := compileFilterExpression(tc.expression)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("expected program\n%v\ngot\n%v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestCompileFilterExpressionVlan(t *testing.T) {
+	tag := func(tci uint16) *uint16 {
+		return &tci
+	}
+
+	cases := []struct {
+		name        string
+		expression  string
+		frame       []byte
+		strippedTCI *uint16
+		expected    bool
+	}{
+		{
+			name:       "plain-match",
+			expression: "ip",
+			frame:      testFrame(etherTypeIPv4),
+			expected:   true,
+		},
+		{
+			name:       "plain-no-match",
+			expression: "ip",
+			frame:      testFrame(etherTypeARP),
+		},
+		{
+			name:       "plain-tagged-in-frame",
+			expression: "ip",
+			frame:      testFrame(etherTypeIPv4, etherTypeDot1Q, 10),
+		},
+		{
+			name:        "stripped-tag",
+			expression:  "vlan 10 and ip",
+			frame:       testFrame(etherTypeIPv4),
+			strippedTCI: tag(10),
+			expected:    true,
+		},
+		{
+			name:        "stripped-tag-with-pcp",
+			expression:  "vlan 10",
+			frame:       testFrame(etherTypeIPv4),
+			strippedTCI: tag(0xa000 | 10),
+			expected:    true,
+		},
+		{
+			name:        "stripped-tag-other-vlan",
+			expression:  "vlan 10",
+			frame:       testFrame(etherTypeIPv4),
+			strippedTCI: tag(20),
+		},
+		{
+			name:       "in-frame-tag",
+			expression: "vlan 10 and ip",
+			frame:      testFrame(etherTypeIPv4, etherTypeDot1Q, 10),
+			expected:   true,
+		},
+		{
+			name:       "in-frame-tag-other-vlan",
+			expression: "vlan 10",
+			frame:      testFrame(etherTypeIPv4, etherTypeDot1Q, 20),
+		},
+		{
+			name:       "in-frame-tag-other-ethertype",
+			expression: "vlan 10 and ip",
+			frame:      testFrame(etherTypeARP, etherTypeDot1Q, 10),
+		},
+		{
+			name:       "untagged",
+			expression: "vlan",
+			frame:      testFrame(etherTypeIPv4),
+		},
+		{
+			name:        "qinq-outer-stripped",
+			expression:  "vlan 100 and vlan 10 and ip",
+			frame:       testFrame(etherTypeIPv4, etherTypeDot1Q, 10),
+			strippedTCI: tag(100),
+			expected:    true,
+		},
+		{
+			name:       "qinq-in-frame",
+			expression: "vlan 100 and vlan 10 and ip",
+			frame:      testFrame(etherTypeIPv4, etherTypeDot1AD, 100, etherTypeDot1Q, 10),
+			expected:   true,
+		},
+		{
+			name:        "qinq-inner-other-vlan",
+			expression:  "vlan 100 and vlan 10",
+			frame:       testFrame(etherTypeIPv4, etherTypeDot1Q, 20),
+			strippedTCI: tag(100),
+		},
+		{
+			// the stripped tag is the outer tag, the inner tag does not make this vlan 10
+			name:        "qinq-inner-tag-only",
+			expression:  "vlan 10",
+			frame:       testFrame(etherTypeIPv4, etherTypeDot1Q, 10),
+			strippedTCI: tag(100),
+		},
+		{
+			// the stripped tag is the outer tag, it can not match the inner vlan primitive
+			name:        "qinq-wrong-order",
+			expression:  "vlan 10 and vlan 100",
+			frame:       testFrame(etherTypeIPv4, etherTypeDot1Q, 10),
+			strippedTCI: tag(100),
+		},
+		{
+			// the stripped tag is only matched once
+			name:        "qinq-stripped-tag-not-reused",
+			expression:  "vlan 100 and vlan 100",
+			frame:       testFrame(etherTypeIPv4),
+			strippedTCI: tag(100),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			program, err := compileFilterExpression(tc.expression)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			actual := runFilter(t, program, tc.frame, tc.strippedTCI) != 0
+			if actual != tc.expected {
+				t.Fatalf("expected match %t, got %t", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestFilterCompilerJumpRange(t *testing.T) {
+	c := &filterCompiler{}
+
+	trueLabel := c.newLabel()
+	falseLabel := c.newLabel()
+
+	c.emit(unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS})
+	c.emitJump(
+		unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K}, trueLabel, falseLabel,
+	)
+
+	for i := 0; i <= bpfMaxJump; i++ {
+		c.emit(unix.SockFilter{Code: unix.BPF_LDX | unix.BPF_IMM})
+	}
+
+	c.place(trueLabel)
+	c.emit(unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: 1})
+
+	for i := 0; i <= bpfMaxJump; i++ {
+		c.emit(unix.SockFilter{Code: unix.BPF_LDX | unix.BPF_IMM})
+	}
+
+	c.place(falseLabel)
+	c.emit(unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: 2})
+
+	program, err := c.resolve()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// both branches are out of range, so both go through a trampoline
+	expected := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 1},
+		{Code: unix.BPF_JMP | unix.BPF_JA, K: bpfMaxJump + 2},
+		{Code: unix.BPF_JMP | unix.BPF_JA, K: 2*bpfMaxJump + 3},
+	}
+
+	if !reflect.DeepEqual(program[:4], expected) {
+		t.Fatalf("expected program to start with\n%v\ngot\n%v", expected, program[:4])
+	}
+
+	if actual := runFilter(t, program, []byte{0, 0, 0, 0}, nil); actual != 1 {
+		t.Fatalf("expected true branch to return 1, got %d", actual)
+	}
+
+	if actual := runFilter(t, program, []byte{0, 0, 0, 1}, nil); actual != 2 {
+		t.Fatalf("expected false branch to return 2, got %d", actual)
+	}
+}
+
+func TestCompileFilterExpressionLarge(t *testing.T) {
+	hosts := make([]string, 0, 40)
+
+	for i := 0; i < 40; i++ {
+		hosts = append(hosts, fmt.Sprintf("ether src 02:00:00:00:00:%02x", i))
+	}
+
+	// a trunk interface's filter is wrapped in its vlan, the vlan's reject branch jumps over the
+	// whole expression
+	program, err := compileFilterExpression(
+		fmt.Sprintf("vlan 10 and (%s)", strings.Join(hosts, " or ")),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	frame := testFrame(etherTypeIPv4, etherTypeDot1Q, 10)
+	frame[11] = 39
+
+	if runFilter(t, program, frame, nil) == 0 {
+		t.Fatalf("expected frame from last host in vlan 10 to match")
+	}
+
+	frame[11] = 40
+
+	if runFilter(t, program, frame, nil) != 0 {
+		t.Fatalf("expected frame from unknown host in vlan 10 not to match")
+	}
+
+	if runFilter(t, program, testFrame(etherTypeIPv4, etherTypeDot1Q, 20), nil) != 0 {
+		t.Fatalf("expected frame in vlan 20 not to match")
+	}
+
+	hosts = hosts[:0]
+
+	for i := 0; i < 1000; i++ {
+		hosts = append(hosts, fmt.Sprintf("ether host 02:00:00:00:%02x:%02x", i>>8, i&0xff))
+	}
+
+	_, err = compileFilterExpression(strings.Join(hosts, " or "))
+	if !errors.Is(err, ErrConfig) {
+		t.Fatalf("expected ErrConfig for filter over the instruction limit, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package slurpeeth
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+const (
+	etherTypeIPv4   = 0x0800
+	etherTypeIPv6   = 0x86dd
+	etherTypeDot1Q  = 0x8100
+	etherTypeDot1AD = 0x88a8
+
+	ethernetHeaderSize = 14
+	ipv4MinHeaderSize  = 20
+	ipv6HeaderSize     = 40
+
+	ipProtoTCP  = 6
+	ipProtoUDP  = 17
+	ipProtoSCTP = 132
+)
+
+// flowHash returns a hash of the flow an ethernet frame belongs to. For IPv4/IPv6 frames this is
+// the 5-tuple (ports only for unfragmented packets), for anything else it is the mac
+// addresses and ethertype. Frames that are too short to parse hash to 0 -- they still need to go
+// *somewhere* and they have no flow to keep in order anyway.
+func flowHash(frame Bytes) uint32 {
+	if len(frame) < ethernetHeaderSize {
+		return 0
+	}
+
+	h := fnv.New32a()
+
+	offset := 12
+	etherType := binary.BigEndian.Uint16(frame[offset:])
+
+	// skip over any vlan tags, the inner ethertype is what we care about
+	for (etherType == etherTypeDot1Q || etherType == etherTypeDot1AD) &&
+		len(frame) >= offset+VlanTagSize+2 {
+		offset += VlanTagSize
+		etherType = binary.BigEndian.Uint16(frame[offset:])
+	}
+
+	offset += 2
+
+	switch etherType {
+	case etherTypeIPv4:
+		if len(frame) >= offset+ipv4MinHeaderSize {
+			ip := frame[offset:]
+			headerLen := int(ip[0]&0x0f) * 4 //nolint:gomnd
+			protocol := ip[9]
+			// more fragments flag and fragment offset -- only unfragmented packets hash their
+			// ports, all fragments of a packet have to take the same stream
+			fragmented := binary.BigEndian.Uint16(ip[6:8])&0x3fff != 0 //nolint:gomnd
+
+			_, _ = h.Write(ip[12:20])
+			_, _ = h.Write([]byte{protocol})
+
+			if !fragmented {
+				writePorts(h.Write, ip, headerLen, protocol)
+			}
+
+			return h.Sum32()
+		}
+	case etherTypeIPv6:
+		if len(frame) >= offset+ipv6HeaderSize {
+			ip := frame[offset:]
+			nextHeader := ip[6]
+
+			_, _ = h.Write(ip[8:40])
+			_, _ = h.Write([]byte{nextHeader})
+
+			writePorts(h.Write, ip, ipv6HeaderSize, nextHeader)
+
+			return h.Sum32()
+		}
+	}
+
+	_, _ = h.Write(frame[0:12])
+	_, _ = h.Write(frame[offset-2 : offset])
+
+	return h.Sum32()
+}
+
+func writePorts(write func(p []byte) (int, error), ip Bytes, headerLen int, protocol byte) {
+	switch protocol {
+	case ipProtoTCP, ipProtoUDP, ipProtoSCTP:
+	default:
+		return
+	}
+
+	if len(ip) < headerLen+4 {
+		return
+	}
+
+	_, _ = write(ip[headerLen : headerLen+4])
+}
@@ -0,0 +1,82 @@
+package slurpeeth
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+const (
+	flowTestMacs = "0200000000bb02000000000a"
+	// flowTestIPv4 is an ipv4 header (udp, 10.0.0.1 -> 10.0.0.2) up to the flags/fragment offset,
+	// and flowTestIPv4Tail the rest of the header, with the udp ports following.
+	flowTestIPv4     = "4500001c00010000"
+	flowTestIPv4Tail = "401100000a0000010a000002"
+)
+
+func flowTestFrame(t *testing.T, tags, fragment, ports string) Bytes {
+	t.Helper()
+
+	b, err := hex.DecodeString(
+		flowTestMacs + tags + "0800" + flowTestIPv4[:12] + fragment + flowTestIPv4Tail + ports,
+	)
+	if err != nil {
+		t.Fatalf("invalid test frame, err: %s", err)
+	}
+
+	return b
+}
+
+func TestFlowHashFragments(t *testing.T) {
+	first := flowHash(flowTestFrame(t, "", "2000", "1f902328"))
+	middle := flowHash(flowTestFrame(t, "", "2017", "deadbeef"))
+	last := flowHash(flowTestFrame(t, "", "002e", "cafef00d"))
+
+	if first != middle || first != last {
+		t.Fatalf(
+			"expected all fragments to hash the same, got %d, %d and %d", first, middle, last,
+		)
+	}
+
+	// dont fragment is not fragmented, ports are hashed
+	a := flowHash(flowTestFrame(t, "", "4000", "1f902328"))
+	b := flowHash(flowTestFrame(t, "", "4000", "1f902329"))
+
+	if a == b {
+		t.Fatal("expected unfragmented packets with different ports to hash differently")
+	}
+}
+
+func TestFlowHashVlanTagged(t *testing.T) {
+	untagged := flowHash(flowTestFrame(t, "", "0000", "1f902328"))
+
+	for name, tags := range map[string]string{
+		"dot1q": "8100000a",
+		"qinq":  "88a800648100000a",
+	} {
+		tagged := flowHash(flowTestFrame(t, tags, "0000", "1f902328"))
+		if tagged != untagged {
+			t.Fatalf("expected %s tagged frame to hash as untagged, got %d and %d",
+				name, tagged, untagged)
+		}
+	}
+}
+
+func TestFlowHashShortFrames(t *testing.T) {
+	if flowHash(Bytes{0x02, 0x00}) != 0 {
+		t.Fatal("expected frames shorter than an ethernet header to hash to 0")
+	}
+
+	full := flowTestFrame(t, "8100000a", "0000", "1f902328")
+
+	// every truncation must be handled, a truncated ip header falls back to the mac addresses
+	for l := 0; l <= len(full); l++ {
+		flowHash(full[:l])
+	}
+
+	truncated := flowHash(full[:ethernetHeaderSize+VlanTagSize+10])
+	other := flowHash(full[:ethernetHeaderSize+VlanTagSize+12])
+
+	if truncated != other {
+		t.Fatalf("expected truncated ip frames to hash by mac, got %d and %d", truncated, other)
+	}
+}
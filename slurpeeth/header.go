@@ -6,6 +6,19 @@ import (
 	"strings"
 )
 
+// MessageType is the type of a slurpeeth message, encoded in the (otherwise reserved) bytes after
+// the sender in the header.
+type MessageType uint8
+
+const (
+	// MessageTypeData is the type of messages carrying a frame -- it encodes as zeros so it is
+	// also what headers from older slurpeeth versions decode as.
+	MessageTypeData MessageType = iota
+	// MessageTypeLinkState is the type of control messages carrying the link state of the
+	// sending end of a segment.
+	MessageTypeLinkState
+)
+
 // Header is an object that is created from the first MessageHeaderSize bytes of a slurpeeth message
 // it can be decoded to indicate the size of the message, and the id of the tunnel the message
 // corresponds to.
@@ -14,6 +27,7 @@ type Header struct {
 	ID     uint16
 	Size   uint16
 	Sender string
+	Type   MessageType
 	// TotalSize is the message size *and* the header size
 	TotalSize uint16
 }
@@ -41,6 +55,17 @@ func (h *Header) parse() error {
 
 	h.Sender = string(h.Body[10:20])
 
+	msgType, err := strconv.Atoi(string(h.Body[20:22]))
+	if err != nil {
+		return fmt.Errorf(
+			"%w: failed to parse message type from header, error: %w",
+			ErrMessage,
+			err,
+		)
+	}
+
+	h.Type = MessageType(msgType)
+
 	return nil
 }
 
@@ -81,15 +106,20 @@ func paddedBytesToUint16(b Bytes) (uint16, error) {
 // NewHeaderFromBody returns a new Header object from the body bytes b. It cannot fail as we are
 // constructing this from bytes so we are ourselves creating the header data.
 func NewHeaderFromBody(id uint16, sender string, b Bytes) Header {
+	return newHeader(id, sender, MessageTypeData, b)
+}
+
+func newHeader(id uint16, sender string, msgType MessageType, b Bytes) Header {
 	l := uint16(len(b))
 
 	return Header{
-		// for now only id (5), size(5), and sender(10) are encoded in the header, then we pad 12
-		// more 0s for future use
-		Body:      []byte(fmt.Sprintf("%05d%05d%s%012d", id, l, sender, 0)),
+		// id (5), size(5), sender(10) and type (2) are encoded in the header, then we pad 10 more
+		// 0s for future use
+		Body:      []byte(fmt.Sprintf("%05d%05d%s%02d%010d", id, l, sender, msgType, 0)),
 		ID:        id,
 		Size:      l,
 		TotalSize: MessageHeaderSize + l,
 		Sender:    sender,
+		Type:      msgType,
 	}
 }
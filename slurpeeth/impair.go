@@ -0,0 +1,402 @@
+package slurpeeth
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const percent = 100
+
+// Impairments holds the impairments of a segment per direction.
+type Impairments struct {
+	// Egress impairs frames read from the segment's local interfaces (on their way to the
+	// segment's destinations and other interfaces).
+	Egress *Impairment `yaml:"egress" json:"egress,omitempty"`
+	// Ingress impairs frames received from remote slurpeeth instances (on their way to the
+	// segment's local interfaces).
+	Ingress *Impairment `yaml:"ingress" json:"ingress,omitempty"`
+}
+
+// Impairment holds netem-like impairment settings. Percentages are 0-100.
+type Impairment struct {
+	// Delay is the fixed delay added to every frame.
+	Delay time.Duration `yaml:"delay"`
+	// Jitter is the maximum random (uniform) variation added to/subtracted from Delay -- frames
+	// can be reordered by jitter, just like with netem.
+	Jitter time.Duration `yaml:"jitter"`
+	// Loss is the percentage of frames randomly dropped.
+	Loss float64 `yaml:"loss"`
+	// GilbertElliott, if set, drops frames per the Gilbert-Elliott (bursty) loss model instead of
+	// randomly per Loss.
+	GilbertElliott *GilbertElliott `yaml:"gilbert-elliott"`
+	// Duplicate is the percentage of frames sent twice.
+	Duplicate float64 `yaml:"duplicate"`
+	// Reorder is the percentage of frames sent immediately (skipping Delay), which reorders them
+	// ahead of delayed frames -- so this only does anything with a Delay.
+	Reorder float64 `yaml:"reorder"`
+	// Corrupt is the percentage of frames that have a single random bit flipped.
+	Corrupt float64 `yaml:"corrupt"`
+}
+
+// GilbertElliott holds the settings of the Gilbert-Elliott loss model -- a two state (good/bad)
+// markov chain with its own loss percentage per state, the same model as netem's "gemodel".
+type GilbertElliott struct {
+	// P is the percentage chance to move from the good state to the bad state (per frame).
+	P float64 `yaml:"p" json:"p"`
+	// R is the percentage chance to move from the bad state to the good state (per frame).
+	R float64 `yaml:"r" json:"r"`
+	// LossGood is the loss percentage in the good state, usually 0.
+	LossGood float64 `yaml:"loss-good" json:"lossGood"`
+	// LossBad is the loss percentage in the bad state, defaults to 100 when unset.
+	LossBad float64 `yaml:"loss-bad" json:"lossBad"`
+}
+
+// impairmentJSON is Impairment with human readable durations, for the api.
+type impairmentJSON struct {
+	Delay          string          `json:"delay,omitempty"`
+	Jitter         string          `json:"jitter,omitempty"`
+	Loss           float64         `json:"loss,omitempty"`
+	GilbertElliott *GilbertElliott `json:"gilbertElliott,omitempty"`
+	Duplicate      float64         `json:"duplicate,omitempty"`
+	Reorder        float64         `json:"reorder,omitempty"`
+	Corrupt        float64         `json:"corrupt,omitempty"`
+}
+
+// MarshalJSON encodes the impairment with durations as strings (like "10ms").
+func (i Impairment) MarshalJSON() ([]byte, error) {
+	raw := impairmentJSON{
+		Loss:           i.Loss,
+		GilbertElliott: i.GilbertElliott,
+		Duplicate:      i.Duplicate,
+		Reorder:        i.Reorder,
+		Corrupt:        i.Corrupt,
+	}
+
+	if i.Delay != 0 {
+		raw.Delay = i.Delay.String()
+	}
+
+	if i.Jitter != 0 {
+		raw.Jitter = i.Jitter.String()
+	}
+
+	return json.Marshal(raw)
+}
+
+// UnmarshalJSON decodes an impairment with durations as strings (like "10ms").
+func (i *Impairment) UnmarshalJSON(b []byte) error {
+	var raw impairmentJSON
+
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return err
+	}
+
+	*i = Impairment{
+		Loss:           raw.Loss,
+		GilbertElliott: raw.GilbertElliott,
+		Duplicate:      raw.Duplicate,
+		Reorder:        raw.Reorder,
+		Corrupt:        raw.Corrupt,
+	}
+
+	if raw.Delay != "" {
+		i.Delay, err = time.ParseDuration(raw.Delay)
+		if err != nil {
+			return err
+		}
+	}
+
+	if raw.Jitter != "" {
+		i.Jitter, err = time.ParseDuration(raw.Jitter)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *Impairment) validate() error {
+	if i.Delay < 0 || i.Jitter < 0 {
+		return fmt.Errorf("%w: impairment delay and jitter can not be negative", ErrConfig)
+	}
+
+	percentages := []float64{i.Loss, i.Duplicate, i.Reorder, i.Corrupt}
+
+	if i.GilbertElliott != nil {
+		if i.Loss != 0 {
+			return fmt.Errorf(
+				"%w: impairment can have loss or gilbert-elliott loss, not both", ErrConfig,
+			)
+		}
+
+		percentages = append(
+			percentages,
+			i.GilbertElliott.P,
+			i.GilbertElliott.R,
+			i.GilbertElliott.LossGood,
+			i.GilbertElliott.LossBad,
+		)
+	}
+
+	for _, p := range percentages {
+		if p < 0 || p > percent {
+			return fmt.Errorf("%w: impairment percentages must be between 0 and 100", ErrConfig)
+		}
+	}
+
+	return nil
+}
+
+// delayedFrame is a frame waiting in an impairer's delay queue.
+type delayedFrame struct {
+	due     time.Time
+	seq     uint64
+	msg     *Message
+	deliver func(*Message)
+}
+
+type delayQueue []delayedFrame
+
+func (q delayQueue) Len() int { return len(q) }
+
+func (q delayQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+
+	return q[i].due.Before(q[j].due)
+}
+
+func (q delayQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *delayQueue) Push(x any) { *q = append(*q, x.(delayedFrame)) } //nolint:forcetypeassert
+
+func (q *delayQueue) Pop() any {
+	old := *q
+	frame := old[len(old)-1]
+	*q = old[:len(old)-1]
+
+	return frame
+}
+
+// impairer applies an Impairment to the frames of one direction of a segment.
+type impairer struct {
+	mu     sync.Mutex
+	config Impairment
+	rand   *rand.Rand
+	// geBad is true while the gilbert-elliott model is in the bad state.
+	geBad bool
+
+	queue  delayQueue
+	seq    uint64
+	wake   chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+func newImpairer(config *Impairment) *impairer {
+	i := &impairer{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())), //nolint:gosec
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+
+	if config != nil {
+		i.config = *config
+	}
+
+	go i.run()
+
+	return i
+}
+
+// set replaces the impairment settings, frames already delayed keep their delay.
+func (i *impairer) set(config Impairment) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.config = config
+	i.geBad = false
+}
+
+func (i *impairer) get() Impairment {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.config
+}
+
+func (i *impairer) chance(p float64) bool {
+	return p > 0 && i.rand.Float64()*percent < p
+}
+
+// lost decides if the next frame is lost, i.mu must be held.
+func (i *impairer) lost() bool {
+	ge := i.config.GilbertElliott
+	if ge == nil {
+		return i.chance(i.config.Loss)
+	}
+
+	if i.geBad {
+		if i.chance(ge.R) {
+			i.geBad = false
+		}
+	} else if i.chance(ge.P) {
+		i.geBad = true
+	}
+
+	if !i.geBad {
+		return i.chance(ge.LossGood)
+	}
+
+	lossBad := ge.LossBad
+	if lossBad == 0 {
+		lossBad = percent
+	}
+
+	return i.chance(lossBad)
+}
+
+// process impairs msg and hands it (or its copies) to deliver -- right away, or later from the
+// impairer's goroutine if the frame is delayed.
+func (i *impairer) process(msg *Message, deliver func(*Message)) {
+	i.mu.Lock()
+
+	if i.closed || i.lost() {
+		i.mu.Unlock()
+
+		return
+	}
+
+	copies := 1
+	if i.chance(i.config.Duplicate) {
+		copies++
+	}
+
+	msgs := make([]*Message, copies)
+
+	for idx := range msgs {
+		msgs[idx] = msg
+
+		if i.chance(i.config.Corrupt) {
+			msgs[idx] = i.corrupt(msg)
+		}
+	}
+
+	var delay time.Duration
+
+	if !i.chance(i.config.Reorder) {
+		delay = i.config.Delay
+
+		if i.config.Jitter > 0 {
+			delay += time.Duration(i.rand.Int63n(int64(2*i.config.Jitter+1))) - i.config.Jitter
+		}
+	}
+
+	if delay <= 0 {
+		i.mu.Unlock()
+
+		for _, m := range msgs {
+			deliver(m)
+		}
+
+		return
+	}
+
+	due := time.Now().Add(delay)
+
+	for _, m := range msgs {
+		i.seq++
+
+		heap.Push(&i.queue, delayedFrame{due: due, seq: i.seq, msg: m, deliver: deliver})
+	}
+
+	i.mu.Unlock()
+
+	select {
+	case i.wake <- struct{}{}:
+	default:
+	}
+}
+
+// corrupt returns a copy of msg with a single random bit of the body flipped, i.mu must be held.
+func (i *impairer) corrupt(msg *Message) *Message {
+	if len(msg.Body) == 0 {
+		return msg
+	}
+
+	corrupted := *msg
+	corrupted.Body = append(Bytes(nil), msg.Body...)
+
+	bit := i.rand.Intn(len(corrupted.Body) * 8) //nolint:gomnd
+
+	corrupted.Body[bit/8] ^= 1 << (bit % 8) //nolint:gomnd
+
+	return &corrupted
+}
+
+func (i *impairer) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		i.mu.Lock()
+
+		var due []delayedFrame
+
+		now := time.Now()
+
+		for len(i.queue) > 0 && !i.queue[0].due.After(now) {
+			due = append(due, heap.Pop(&i.queue).(delayedFrame)) //nolint:forcetypeassert
+		}
+
+		wait := time.Hour
+		if len(i.queue) > 0 {
+			wait = i.queue[0].due.Sub(now)
+		}
+
+		i.mu.Unlock()
+
+		for _, frame := range due {
+			frame.deliver(frame.msg)
+		}
+
+		if len(due) > 0 {
+			// delivering may have taken a while, check again before sleeping
+			continue
+		}
+
+		timer.Reset(wait)
+
+		select {
+		case <-i.done:
+			return
+		case <-i.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+// close stops the impairer, any frames still delayed are dropped.
+func (i *impairer) close() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.closed {
+		return
+	}
+
+	i.closed = true
+	i.queue = nil
+
+	close(i.done)
+}
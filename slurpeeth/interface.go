@@ -1,13 +1,16 @@
 package slurpeeth
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"net"
-	"os/exec"
 )
 
+// errInterfaceNotFound is returned (wrapped) when an interface (or its network namespace) does not
+// exist (yet?) -- workers treat this as "wait for the interface to show up" rather than a fatal
+// error.
+var errInterfaceNotFound = fmt.Errorf("%w: interface not found", ErrBind)
+
 func interfaceByNameOrAlias(interfaceNameOrAlias string) (*net.Interface, error) {
 	namedInterface, err := net.InterfaceByName(interfaceNameOrAlias)
 	if err == nil {
@@ -20,34 +23,40 @@ func interfaceByNameOrAlias(interfaceNameOrAlias string) (*net.Interface, error)
 		interfaceNameOrAlias,
 	)
 
-	namedInterfaces, err := net.Interfaces()
+	links, err := listLinks()
 	if err != nil {
 		log.Printf("failed listing interfaces, error: %s", err)
 
 		return nil, err
 	}
 
-	for _, i := range namedInterfaces {
-		showCmd := exec.Command("ip", "link", "show", i.Name) //nolint: gosec
-
-		var b []byte
-
-		b, err = showCmd.CombinedOutput()
-		if err != nil {
-			log.Printf("failed executing 'ip link show', error: %s", err)
-
+	for _, link := range links {
+		if !link.matchesNameOrAlias(interfaceNameOrAlias) {
 			continue
 		}
 
-		if (bytes.Contains(b, []byte("alias")) || bytes.Contains(b, []byte("altname"))) &&
-			bytes.Contains(b, []byte(interfaceNameOrAlias)) {
-			return &i, nil
-		}
+		return net.InterfaceByIndex(link.index)
 	}
 
 	return nil, fmt.Errorf(
 		"%w: could not find interface name %q as interface name or as alias/altname",
-		ErrBind,
+		errInterfaceNotFound,
 		interfaceNameOrAlias,
 	)
 }
+
+// matchesNameOrAlias returns true if s is *exactly* the link's name, alias or one of its
+// alternative names.
+func (l *linkInfo) matchesNameOrAlias(s string) bool {
+	if l.name == s || l.alias == s {
+		return true
+	}
+
+	for _, altName := range l.altNames {
+		if altName == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,474 @@
+package slurpeeth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// linkMonitor receives link (RTM_NEWLINK/RTM_DELLINK) notifications for a network namespace. For
+// namespaces other than our own it also watches the namespace itself -- if the namespace goes away
+// or is replaced by a new one behind the same name (a node restarting) the interfaces bound in the
+// old namespace are released, and the monitor reopens in (and resyncs) the new namespace once it
+// exists.
+type linkMonitor struct {
+	namespace string
+	handler   func(info linkInfo, deleted bool)
+	resync    func()
+	gone      func()
+
+	// mu guards file and inode, the socket subscribed in the current namespace (nil while the
+	// namespace does not exist) and the inode of that namespace.
+	mu    sync.Mutex
+	file  *os.File
+	inode uint64
+	done  chan struct{}
+}
+
+func newLinkMonitor(
+	namespace string,
+	handler func(info linkInfo, deleted bool),
+	resync func(),
+	gone func(),
+) *linkMonitor {
+	return &linkMonitor{
+		namespace: namespace,
+		handler:   handler,
+		resync:    resync,
+		gone:      gone,
+		done:      make(chan struct{}),
+	}
+}
+
+// open opens a netlink socket subscribed to link notifications in the monitor's namespace, the
+// caller starts reading it (see run) once it has caught up on anything it may have missed.
+func (m *linkMonitor) open() (*os.File, error) {
+	var inode uint64
+
+	if m.namespace != "" {
+		var err error
+
+		inode, err = netnsInode(m.namespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var fd int
+
+	// the socket stays in the namespace it was created in, so we only need to be there to open it
+	err := runInNetns(m.namespace, func() error {
+		var err error
+
+		fd, err = unix.Socket(
+			unix.AF_NETLINK,
+			unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK,
+			unix.NETLINK_ROUTE,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = unix.Bind(fd, &unix.SockaddrNetlink{
+			Family: unix.AF_NETLINK,
+			Groups: 1 << (unix.RTNLGRP_LINK - 1),
+		})
+		if err != nil {
+			_ = unix.Close(fd)
+
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf(
+			"%w: failed opening link monitor for namespace %q, error: %w",
+			ErrBind,
+			m.namespace,
+			err,
+		)
+	}
+
+	// non-blocking + os.NewFile puts the socket in the runtime poller, so closing the file wakes
+	// up the pending read
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("link-monitor-%s", m.namespace))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.done:
+		_ = file.Close()
+
+		return nil, fmt.Errorf("%w: link monitor for namespace %q", os.ErrClosed, m.namespace)
+	default:
+	}
+
+	m.file = file
+	m.inode = inode
+
+	return file, nil
+}
+
+// run calls handler for every link notification read from file until file is closed. If the
+// kernel drops notifications (our socket buffer overflowed) resync is called to catch up.
+func (m *linkMonitor) run(file *os.File) {
+	buf := make([]byte, unix.Getpagesize()*8) //nolint:gomnd
+
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+
+			if errors.Is(err, unix.ENOBUFS) {
+				log.Printf(
+					"link monitor for namespace %q dropped notifications, resyncing", m.namespace,
+				)
+
+				m.resync()
+
+				continue
+			}
+
+			log.Printf("link monitor for namespace %q stopped, err: %s", m.namespace, err)
+
+			return
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			log.Printf("ignoring unparseable link notification, err: %s", err)
+
+			continue
+		}
+
+		for _, msg := range msgs {
+			if msg.Header.Type != unix.RTM_NEWLINK && msg.Header.Type != unix.RTM_DELLINK {
+				continue
+			}
+
+			info, err := parseLinkInfo(msg.Data)
+			if err != nil {
+				log.Printf("ignoring unparseable link notification, err: %s", err)
+
+				continue
+			}
+
+			m.handler(info, msg.Header.Type == unix.RTM_DELLINK)
+		}
+	}
+}
+
+// watch polls the monitor's namespace until the monitor is closed, releasing interfaces when the
+// namespace goes away or is replaced and reopening the monitor when (a new) one exists.
+func (m *linkMonitor) watch() {
+	ticker := time.NewTicker(netnsPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+
+		inode, err := netnsInode(m.namespace)
+
+		m.mu.Lock()
+		current := m.file != nil && m.inode == inode
+		m.mu.Unlock()
+
+		if err == nil && current {
+			continue
+		}
+
+		if m.release() {
+			log.Printf(
+				"network namespace %q went away or was replaced, releasing its interfaces",
+				m.namespace,
+			)
+
+			m.gone()
+		}
+
+		if err != nil {
+			// (still) missing, keep waiting for it
+			continue
+		}
+
+		file, err := m.open()
+		if err != nil {
+			log.Printf("failed reopening link monitor, will retry, err: %s", err)
+
+			continue
+		}
+
+		log.Printf("network namespace %q appeared, resyncing its interfaces", m.namespace)
+
+		m.resync()
+
+		go m.run(file)
+	}
+}
+
+// release closes the socket of the current namespace, returning true if there was one.
+func (m *linkMonitor) release() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.file == nil {
+		return false
+	}
+
+	_ = m.file.Close()
+
+	m.file = nil
+	m.inode = 0
+
+	return true
+}
+
+func (m *linkMonitor) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	close(m.done)
+
+	if m.file == nil {
+		return nil
+	}
+
+	err := m.file.Close()
+
+	m.file = nil
+
+	return err
+}
+
+// startLinkMonitors starts a link monitor for each namespace that has interfaces slurpeeth did not
+// create itself -- those are the interfaces that can come and go out from under us. Once a
+// monitor is subscribed, the namespace is resynced in case interfaces came or went before we were
+// watching (notifications from then on queue up on the monitor's socket). Namespaces that do not
+// exist (yet?) are waited on by the monitor's watch.
+func (w *Worker) startLinkMonitors() {
+	namespaces := map[string]bool{}
+
+	for idx := range w.interfaces {
+		if w.interfaces[idx].create != "" || namespaces[w.interfaces[idx].namespace] {
+			continue
+		}
+
+		namespace := w.interfaces[idx].namespace
+
+		namespaces[namespace] = true
+
+		monitor := newLinkMonitor(
+			namespace,
+			func(info linkInfo, deleted bool) {
+				w.handleLinkNotification(namespace, info, deleted)
+			},
+			func() {
+				w.resyncInterfaces(namespace)
+			},
+			func() {
+				w.namespaceGone(namespace)
+			},
+		)
+
+		w.linkMonitors = append(w.linkMonitors, monitor)
+
+		file, err := monitor.open()
+
+		switch {
+		case errors.Is(err, errInterfaceNotFound):
+			log.Printf(
+				"network namespace %q for tunnel id %d does not exist (yet?), waiting for it to"+
+					" appear",
+				namespace, w.segment.ID,
+			)
+		case err != nil:
+			// not fatal, but we wont notice interfaces coming or going in this namespace (until
+			// the watch manages to reopen it, if it is not our own)
+			log.Printf(
+				"failed starting link monitor for tunnel id %d, hotplug disabled for namespace"+
+					" %q, err: %s",
+				w.segment.ID, namespace, err,
+			)
+		default:
+			w.resyncInterfaces(namespace)
+
+			go monitor.run(file)
+		}
+
+		if namespace != "" {
+			go monitor.watch()
+		}
+	}
+}
+
+func (w *Worker) stopLinkMonitors() {
+	for _, monitor := range w.linkMonitors {
+		err := monitor.close()
+		if err != nil {
+			log.Printf(
+				"ignoring error closing link monitor for namespace %q for tunnel id %d, err: %s",
+				monitor.namespace, w.segment.ID, err,
+			)
+		}
+	}
+
+	w.linkMonitors = nil
+}
+
+func (w *Worker) handleLinkNotification(namespace string, info linkInfo, deleted bool) {
+	if w.shutdownInProgress {
+		return
+	}
+
+	for idx := range w.interfaces {
+		if w.interfaces[idx].create != "" || w.interfaces[idx].namespace != namespace {
+			continue
+		}
+
+		w.interfaces[idx].mu.Lock()
+		waiting := w.interfaces[idx].waiting
+		ifindex := w.interfaces[idx].ifindex
+		handle := w.interfaces[idx].io
+		w.interfaces[idx].mu.Unlock()
+
+		switch {
+		case deleted && !waiting && ifindex == info.index:
+			w.interfaceGone(idx, handle)
+		case !deleted && waiting && info.matchesNameOrAlias(w.interfaces[idx].name):
+			w.interfaces[idx].mu.Lock()
+			w.interfaces[idx].ifindex = info.index
+			w.interfaces[idx].mu.Unlock()
+
+			w.rebindInterface(idx)
+		}
+
+		if !deleted {
+			w.interfaces[idx].mu.Lock()
+
+			if !w.interfaces[idx].waiting && w.interfaces[idx].ifindex == info.index {
+				w.interfaces[idx].operUp = linkOperUp(info.flags)
+			}
+
+			w.interfaces[idx].mu.Unlock()
+		}
+	}
+
+	w.propagateLinkState()
+}
+
+// resyncInterfaces re-checks all interfaces in namespace -- releasing those that have gone and
+// binding those that we are waiting on that now exist.
+func (w *Worker) resyncInterfaces(namespace string) {
+	for idx := range w.interfaces {
+		if w.shutdownInProgress {
+			return
+		}
+
+		if w.interfaces[idx].create != "" || w.interfaces[idx].namespace != namespace {
+			continue
+		}
+
+		if !w.interfaces[idx].isWaiting() {
+			handle := w.interfaces[idx].currentIO()
+
+			if !w.interfaces[idx].exists() {
+				w.interfaceGone(idx, handle)
+			}
+
+			continue
+		}
+
+		err := w.interfaces[idx].lookup()
+		if err != nil {
+			continue
+		}
+
+		w.rebindInterface(idx)
+	}
+
+	w.propagateLinkState()
+}
+
+// namespaceGone releases the bindings of all interfaces in namespace -- the namespace was deleted
+// or replaced, so whatever we are bound to is not the node's interface anymore, even if an
+// interface with the same index exists in the new namespace.
+func (w *Worker) namespaceGone(namespace string) {
+	for idx := range w.interfaces {
+		if w.shutdownInProgress {
+			return
+		}
+
+		if w.interfaces[idx].create != "" || w.interfaces[idx].namespace != namespace {
+			continue
+		}
+
+		w.interfaceGone(idx, w.interfaces[idx].currentIO())
+	}
+
+	w.propagateLinkState()
+}
+
+// rebindInterface binds an interface we were waiting on and starts reading from it, the writer
+// for the interface is already running and picks up the new binding on its own.
+func (w *Worker) rebindInterface(idx int) {
+	log.Printf(
+		"interface %q for tunnel id %d appeared, binding",
+		w.interfaces[idx].name, w.segment.ID,
+	)
+
+	err := w.bindInterface(idx)
+	if err != nil {
+		// probably gone again already, keep waiting
+		log.Printf(
+			"failed binding to interface %q for tunnel id %d, waiting for it to return, err: %s",
+			w.interfaces[idx].name, w.segment.ID, err,
+		)
+
+		return
+	}
+
+	go w.runInterfaceRead(idx, w.interfaces[idx].currentIO())
+}
+
+// interfaceGone releases the binding (handle) of an interface that no longer exists and goes back
+// to waiting for it -- handle guards against releasing a newer binding than the caller saw.
+func (w *Worker) interfaceGone(idx int, handle interfaceIO) {
+	w.interfaces[idx].mu.Lock()
+	defer w.interfaces[idx].mu.Unlock()
+
+	if w.interfaces[idx].waiting || w.interfaces[idx].io != handle {
+		return
+	}
+
+	log.Printf(
+		"interface %q for tunnel id %d went away, waiting for it to return",
+		w.interfaces[idx].name, w.segment.ID,
+	)
+
+	if handle != nil {
+		err := handle.close()
+		if err != nil {
+			log.Printf(
+				"ignoring error closing interface %q for tunnel id %d, err: %s",
+				w.interfaces[idx].name, w.segment.ID, err,
+			)
+		}
+	}
+
+	w.interfaces[idx].io = nil
+	w.interfaces[idx].waiting = true
+}
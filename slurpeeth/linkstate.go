@@ -0,0 +1,284 @@
+package slurpeeth
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// linkStateRefreshInterval is how often the link state of a segment end is re-sent even if it did
+// not change -- so peers that (re)connect later, or missed a message, converge.
+const linkStateRefreshInterval = 10 * time.Second
+
+// linkSettleTime is how long the down state of a just restored interface is ignored -- links
+// take a moment to come up after being restored, and reporting them as down in the meantime
+// would have the peer force its end down again.
+const linkSettleTime = 2 * time.Second
+
+func validateLinkStatePropagation(segment *Segment) error {
+	switch segment.PropagateLinkState {
+	case "":
+		return nil
+	case LinkDownCarrier, LinkDownAdmin:
+	default:
+		return fmt.Errorf(
+			"%w: unsupported propagate-link-state mode %q", ErrConfig, segment.PropagateLinkState,
+		)
+	}
+
+	if len(segment.Interfaces) == 0 {
+		return fmt.Errorf(
+			"%w: propagate-link-state requires the segment to have a local interface", ErrConfig,
+		)
+	}
+
+	return nil
+}
+
+// newLinkStateMessage returns a link state control message for tunnel id.
+func newLinkStateMessage(id uint16, sender string, up bool) Message {
+	body := Bytes{0}
+	if up {
+		body[0] = 1
+	}
+
+	return Message{
+		Header: newHeader(id, sender, MessageTypeLinkState, body),
+		Body:   body,
+	}
+}
+
+// linkOperUp returns true if flags (of a link notification) say the link is operationally up.
+func linkOperUp(flags uint32) bool {
+	return flags&unix.IFF_UP != 0 && flags&unix.IFF_RUNNING != 0
+}
+
+// localLinkUp returns the link state of this end of the segment -- up if any of its interfaces is
+// up. Interfaces forced down by a peer are ignored (their state is the peer's state, reporting it
+// back would be a feedback loop), as are interfaces slurpeeth created (whose state we do not
+// monitor) unless they were forced down via setAdminDown. known is false if no interface counts.
+func (w *Worker) localLinkUp() (up, known bool) {
+	for idx := range w.interfaces {
+		i := w.interfaces[idx]
+
+		i.mu.Lock()
+
+		switch {
+		case i.linkForcedRemote || (i.create != "" && i.linkForced == ""):
+		case i.linkForced == "" && !i.waiting && i.operUp:
+			known = true
+			up = true
+		case time.Since(i.restoredAt) < linkSettleTime:
+			// still settling, dont know yet
+		default:
+			known = true
+		}
+
+		i.mu.Unlock()
+	}
+
+	return up, known
+}
+
+// propagateLinkState sends the link state of this end of the segment to peers if it changed.
+func (w *Worker) propagateLinkState() {
+	if w.segment.PropagateLinkState == "" {
+		return
+	}
+
+	up, known := w.localLinkUp()
+	if !known {
+		return
+	}
+
+	w.linkStateLock.Lock()
+	defer w.linkStateLock.Unlock()
+
+	if w.linkStateDone == nil {
+		// not started (yet, or anymore)
+		return
+	}
+
+	if w.linkStateKnown && w.linkStateUp == up {
+		return
+	}
+
+	w.linkStateKnown = true
+	w.linkStateUp = up
+
+	log.Printf("link state of tunnel id %d is now %s, propagating", w.segment.ID, linkState(up))
+
+	// only the latest state matters, replace anything not picked up yet
+	select {
+	case <-w.linkStateChan:
+	default:
+	}
+
+	w.linkStateChan <- up
+}
+
+func linkState(up bool) string {
+	if up {
+		return "up"
+	}
+
+	return "down"
+}
+
+// startLinkStatePropagation reads the initial state of the segment's interfaces and starts sending
+// the segment's link state to peers.
+func (w *Worker) startLinkStatePropagation() {
+	if w.segment.PropagateLinkState == "" {
+		return
+	}
+
+	for idx := range w.interfaces {
+		i := w.interfaces[idx]
+
+		if i.create != "" || i.isWaiting() {
+			continue
+		}
+
+		var info linkInfo
+
+		err := runInNetns(i.namespace, func() error {
+			var err error
+
+			info, err = getLink(i.ifindex)
+
+			return err
+		})
+		if err != nil {
+			log.Printf(
+				"failed reading link state of interface %q for tunnel id %d, err: %s",
+				i.name, w.segment.ID, err,
+			)
+
+			continue
+		}
+
+		i.mu.Lock()
+		i.operUp = linkOperUp(info.flags)
+		i.mu.Unlock()
+	}
+
+	done := make(chan struct{})
+
+	w.linkStateLock.Lock()
+	w.linkStateDone = done
+	w.linkStateLock.Unlock()
+
+	go w.runLinkStatePropagation(done)
+
+	w.propagateLinkState()
+}
+
+func (w *Worker) stopLinkStatePropagation() {
+	w.linkStateLock.Lock()
+	defer w.linkStateLock.Unlock()
+
+	if w.linkStateDone != nil {
+		close(w.linkStateDone)
+
+		w.linkStateDone = nil
+	}
+}
+
+func (w *Worker) runLinkStatePropagation(done chan struct{}) {
+	ticker := time.NewTicker(linkStateRefreshInterval)
+	defer ticker.Stop()
+
+	var up, known bool
+
+	for {
+		select {
+		case <-done:
+			return
+		case up = <-w.linkStateChan:
+			known = true
+		case <-ticker.C:
+			if !known {
+				continue
+			}
+		}
+
+		msg := newLinkStateMessage(w.segment.ID, w.interfaces[0].sender, up)
+
+		// one stream per destination is enough, and control messages are never shaped
+		for _, group := range w.destinationGroups {
+			w.destinations[group[0]].sendChan <- &msg
+		}
+	}
+}
+
+// handleLinkStateMessage applies the link state a peer sent -- forcing the segment's interfaces
+// down when the peer's end is down, and restoring them when it comes back.
+func (w *Worker) handleLinkStateMessage(msg *Message) {
+	if w.segment.PropagateLinkState == "" || len(msg.Body) != 1 {
+		return
+	}
+
+	up := msg.Body[0] == 1
+
+	for idx := range w.interfaces {
+		var err error
+
+		if up {
+			err = w.restoreRemoteLink(idx)
+		} else {
+			err = w.forceLinkDownRemote(idx)
+		}
+
+		if err != nil {
+			log.Printf(
+				"failed applying peer link state %s to interface %q for tunnel id %d, err: %s",
+				linkState(up), w.interfaces[idx].name, w.segment.ID, err,
+			)
+		}
+	}
+}
+
+// forceLinkDownRemote forces the link of interface idx down because the peer's end is down.
+func (w *Worker) forceLinkDownRemote(idx int) error {
+	i := w.interfaces[idx]
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.waiting || i.linkForced != "" {
+		return nil
+	}
+
+	err := i.setLinkState(w.segment.PropagateLinkState, false)
+	if err != nil {
+		return err
+	}
+
+	i.linkForced = w.segment.PropagateLinkState
+	i.linkForcedRemote = true
+
+	log.Printf(
+		"peer of tunnel id %d is down, forced %s of interface %q down",
+		w.segment.ID, i.linkForced, i.name,
+	)
+
+	return nil
+}
+
+// restoreRemoteLink restores the link of interface idx if (and only if) it was forced down because
+// the peer's end was down.
+func (w *Worker) restoreRemoteLink(idx int) error {
+	i := w.interfaces[idx]
+
+	i.mu.Lock()
+	remote := i.linkForcedRemote
+	i.mu.Unlock()
+
+	if !remote {
+		return nil
+	}
+
+	return w.restoreLink(idx)
+}
@@ -1,23 +1,26 @@
 package slurpeeth
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 )
 
 // NewListener returns a new listener listening on 127.0.0.1 and the slurpeeth port.
 func NewListener(
 	address string,
 	port uint16,
+	tcpOptions TCPOptions,
 	messageRelay func(id uint16, m *Message),
 	errChan chan error,
 	shutdownChan chan bool,
 ) (*Listener, error) {
 	listener := &Listener{
-		addr:         fmt.Sprintf("%s:%d", address, port),
+		addr:         net.JoinHostPort(address, strconv.Itoa(int(port))),
+		tcpOptions:   tcpOptions,
 		l:            nil,
 		messageRelay: messageRelay,
 		errChan:      errChan,
@@ -31,6 +34,7 @@ func NewListener(
 // based on tunnel id (via the manager).
 type Listener struct {
 	addr         string
+	tcpOptions   TCPOptions
 	l            net.Listener
 	messageRelay func(id uint16, m *Message)
 	errChan      chan error
@@ -40,7 +44,7 @@ type Listener struct {
 // Bind starts the listener/binds it to the address/port it was created with. It must be called
 // before Run.
 func (l *Listener) Bind() error {
-	lis, err := net.Listen(TCP, l.addr)
+	lis, err := l.tcpOptions.listenConfig().Listen(context.Background(), TCP, l.addr)
 	if err != nil {
 		return err
 	}
@@ -91,7 +95,24 @@ func (l *Listener) Run() {
 }
 
 func (l *Listener) handle(conn net.Conn) {
-	log.Printf("received new connection from %q", conn.RemoteAddr())
+	log.Printf(
+		"received new connection from %q, multipath tcp %s",
+		conn.RemoteAddr(),
+		l.tcpOptions.multipathStatus(conn),
+	)
+
+	err := l.tcpOptions.apply(conn)
+	if err != nil {
+		log.Printf(
+			"encountered error applying tcp options to connection from %q, closing it, err: %s",
+			conn.RemoteAddr(), err,
+		)
+
+		// only this connection is affected, the peer will re-dial
+		_ = conn.Close()
+
+		return
+	}
 
 	for {
 		m, err := NewMessageFromConn(conn)
@@ -111,10 +132,14 @@ func (l *Listener) handle(conn net.Conn) {
 			break
 		}
 
-		go l.messageRelay(m.Header.ID, &m)
+		m.remote = conn.RemoteAddr()
+
+		// relay in the order the messages arrived -- each stream carries whole flows (see
+		// flowHash) and those must stay in order, a slow worker just backs up this connection
+		l.messageRelay(m.Header.ID, &m)
 	}
 
-	err := conn.Close()
+	err = conn.Close()
 	if err != nil {
 		log.Printf(
 			"encountered error closing connection from %q, will ignore. error: %s",
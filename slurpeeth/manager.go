@@ -38,6 +38,9 @@ type manager struct {
 	// maximum duration workers will try to dial a destination -- defaults to 1 minute.
 	dialTimeout time.Duration
 
+	// socket tuning applied to both dialed and accepted tunnel connections.
+	tcpOptions TCPOptions
+
 	// channel to receiver errors from the workers on.
 	errChan chan error
 
@@ -46,8 +49,21 @@ type manager struct {
 	listenerShutdownChan chan bool
 	listener             *Listener
 
-	// workers is a mapping of Worker -- the key is the uint16 tunnel id.
-	workers map[uint16]*Worker
+	// workers is a mapping of Worker -- the key is the uint16 tunnel id. workersLock guards the
+	// map for readers outside the manager's own goroutine (the listener and the api).
+	workers     map[uint16]*Worker
+	workersLock sync.RWMutex
+
+	// apiAddress is the address the runtime api listens on, empty to disable the api.
+	apiAddress string
+	// captureDir is the directory captures started via the api are written to, empty to only
+	// allow (re)starting the captures in the config.
+	captureDir string
+
+	// scenarios holds the scenarios started via the api (running and finished), by id.
+	scenarios     map[int]*scenarioRun
+	scenarioCount int
+	scenariosLock sync.Mutex
 }
 
 var managerInst *manager //nolint:gochecknoglobals
@@ -74,6 +90,10 @@ func GetManager(opts ...Option) (Manager, error) {
 		errChan:              make(chan error),
 		listenerShutdownChan: make(chan bool),
 		workers:              map[uint16]*Worker{},
+		scenarios:            map[int]*scenarioRun{},
+		tcpOptions: TCPOptions{
+			NoDelay: true,
+		},
 	}
 
 	for _, opt := range opts {
@@ -146,6 +166,15 @@ func (m *manager) run() error {
 
 	m.startListener()
 
+	log.Println("starting api...")
+
+	err = m.startAPI()
+	if err != nil {
+		log.Printf("error starting api: %s\n", err)
+
+		return err
+	}
+
 	log.Println("processing watch config...")
 
 	err = m.watchConfig()
@@ -169,6 +198,8 @@ func (m *manager) Run() error {
 
 	<-m.ctx.Done()
 
+	m.releaseInterfaces()
+
 	if m.errored {
 		log.Println("root context signaled done with error, exiting...")
 
@@ -193,6 +224,8 @@ func (m *manager) RunDaemon(exitErr, exitDone chan bool) error {
 	go func() {
 		<-m.ctx.Done()
 
+		m.releaseInterfaces()
+
 		if m.errored {
 			log.Println("root context signaled done with error, exiting...")
 
@@ -224,6 +257,7 @@ func (m *manager) setupWorkers() error {
 		worker, err := NewWorker(
 			m.port,
 			m.dialTimeout,
+			m.tcpOptions,
 			segmentConfig,
 			m.errChan,
 			m.workerRetry,
@@ -238,12 +272,36 @@ func (m *manager) setupWorkers() error {
 			return err
 		}
 
+		m.workersLock.Lock()
 		m.workers[segmentConfig.ID] = worker
+		m.workersLock.Unlock()
 	}
 
 	return nil
 }
 
+func (m *manager) getWorker(id uint16) (*Worker, bool) {
+	m.workersLock.RLock()
+	defer m.workersLock.RUnlock()
+
+	worker, ok := m.workers[id]
+
+	return worker, ok
+}
+
+func (m *manager) workerList() []*Worker {
+	m.workersLock.RLock()
+	defer m.workersLock.RUnlock()
+
+	workers := make([]*Worker, 0, len(m.workers))
+
+	for _, worker := range m.workers {
+		workers = append(workers, worker)
+	}
+
+	return workers
+}
+
 func (m *manager) startWorkers() {
 	for _, segment := range m.workers {
 		segment.Run()
@@ -262,8 +320,23 @@ func (m *manager) shutdownWorkers() {
 	wg.Wait()
 }
 
+// releaseInterfaces closes the interfaces of all workers without waiting for an orderly worker
+// shutdown -- this is used when exiting so that any interfaces slurpeeth created are cleaned up.
+func (m *manager) releaseInterfaces() {
+	for _, worker := range m.workers {
+		worker.releaseInterfaces()
+	}
+}
+
 func (m *manager) setupListener() error {
-	l, err := NewListener(m.address, m.port, m.messageRelay, m.errChan, m.listenerShutdownChan)
+	l, err := NewListener(
+		m.address,
+		m.port,
+		m.tcpOptions,
+		m.messageRelay,
+		m.errChan,
+		m.listenerShutdownChan,
+	)
 	if err != nil {
 		return err
 	}
@@ -283,19 +356,22 @@ func (m *manager) startListener() {
 }
 
 func (m *manager) messageRelay(id uint16, msg *Message) {
-	worker, ok := m.workers[id]
+	worker, ok := m.getWorker(id)
 	if !ok {
 		log.Printf("message received for tunnel id %d, but no worker present for this tunnel", id)
 
 		return
 	}
 
-	for idx := range worker.interfaces {
-		if msg.Header.Sender == worker.interfaces[idx].sender {
-			// message came from this worker, dont send it back to them
-			continue
-		}
-
-		worker.interfaces[idx].sendChan <- msg
+	switch msg.Header.Type {
+	case MessageTypeData:
+		worker.captureRemote(msg)
+		worker.ingressImpairer.process(msg, worker.forwardFromRemote)
+	case MessageTypeLinkState:
+		worker.handleLinkStateMessage(msg)
+	default:
+		log.Printf(
+			"ignoring message of unknown type %d for tunnel id %d", msg.Header.Type, id,
+		)
 	}
 }
@@ -0,0 +1,105 @@
+package slurpeeth
+
+import (
+	"fmt"
+	"log"
+
+	"golang.org/x/sys/unix"
+)
+
+// packetMembership holds PACKET_MR_PROMISC/PACKET_MR_ALLMULTI memberships for an interface. The
+// memberships are held by their own (non-receiving) AF_PACKET socket so that they work the same
+// regardless of the interface's backend, and so they are dropped again when the binding is closed
+// -- leaving the interface in the state we found it.
+type packetMembership struct {
+	name  string
+	fd    int
+	mreqs []unix.PacketMreq
+}
+
+func newPacketMembership(
+	name string,
+	ifindex int,
+	promisc, allMulti bool,
+) (*packetMembership, error) {
+	// protocol 0 -- this socket never receives any frames, it only holds the memberships
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"%w: failed opening membership socket for interface %q, error: %w", ErrBind, name, err,
+		)
+	}
+
+	m := &packetMembership{
+		name: name,
+		fd:   fd,
+	}
+
+	if promisc {
+		m.mreqs = append(
+			m.mreqs, unix.PacketMreq{Ifindex: int32(ifindex), Type: unix.PACKET_MR_PROMISC},
+		)
+	}
+
+	if allMulti {
+		m.mreqs = append(
+			m.mreqs, unix.PacketMreq{Ifindex: int32(ifindex), Type: unix.PACKET_MR_ALLMULTI},
+		)
+	}
+
+	for idx := range m.mreqs {
+		err = unix.SetsockoptPacketMreq(
+			fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &m.mreqs[idx],
+		)
+		if err != nil {
+			// closing the socket drops any memberships we already added
+			_ = unix.Close(fd)
+
+			return nil, fmt.Errorf(
+				"%w: failed adding membership type %d for interface %q, error: %w",
+				ErrBind,
+				m.mreqs[idx].Type,
+				name,
+				err,
+			)
+		}
+	}
+
+	return m, nil
+}
+
+func (m *packetMembership) close() error {
+	for idx := range m.mreqs {
+		err := unix.SetsockoptPacketMreq(
+			m.fd, unix.SOL_PACKET, unix.PACKET_DROP_MEMBERSHIP, &m.mreqs[idx],
+		)
+		if err != nil {
+			// the interface may already be gone, the kernel cleans up after itself in that case
+			log.Printf(
+				"ignoring error dropping membership type %d for interface %q, err: %s",
+				m.mreqs[idx].Type, m.name, err,
+			)
+		}
+	}
+
+	return unix.Close(m.fd)
+}
+
+// membershipIO is an interfaceIO that holds memberships for the interface for as long as the
+// wrapped interfaceIO is open.
+type membershipIO struct {
+	interfaceIO
+	membership *packetMembership
+}
+
+func (m *membershipIO) close() error {
+	err := m.membership.close()
+	if err != nil {
+		log.Printf(
+			"ignoring error closing membership socket for interface %q, err: %s",
+			m.membership.name, err,
+		)
+	}
+
+	return m.interfaceIO.close()
+}
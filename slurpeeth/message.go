@@ -76,6 +76,10 @@ func NewMessageFromConn(conn net.Conn) (Message, error) {
 type Message struct {
 	Header Header
 	Body   Bytes
+
+	// remote is the address of the connection the message was received on, nil for messages read
+	// from local interfaces.
+	remote net.Addr
 }
 
 // Output returns the full bytes of the Message including the header.
@@ -0,0 +1,319 @@
+package slurpeeth
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// vethInfoPeer is VETH_INFO_PEER from linux/veth.h, it is not in x/sys/unix.
+const vethInfoPeer = 1
+
+var netlinkSeq atomic.Uint32 //nolint:gochecknoglobals
+
+// netlinkAttr is a (possibly nested) route netlink attribute.
+type netlinkAttr struct {
+	attrType uint16
+	data     []byte
+	children []netlinkAttr
+}
+
+func (a netlinkAttr) encode() []byte {
+	payload := a.data
+
+	for _, child := range a.children {
+		payload = append(payload, child.encode()...)
+	}
+
+	l := unix.SizeofRtAttr + len(payload)
+
+	b := make([]byte, netlinkAlign(l))
+
+	binary.NativeEndian.PutUint16(b[0:2], uint16(l))
+	binary.NativeEndian.PutUint16(b[2:4], a.attrType)
+
+	copy(b[unix.SizeofRtAttr:], payload)
+
+	return b
+}
+
+func netlinkAlign(l int) int {
+	return (l + unix.NLA_ALIGNTO - 1) & ^(unix.NLA_ALIGNTO - 1)
+}
+
+func netlinkAttrString(attrType uint16, s string) netlinkAttr {
+	return netlinkAttr{attrType: attrType, data: append([]byte(s), 0)}
+}
+
+func netlinkAttrUint32(attrType uint16, v uint32) netlinkAttr {
+	b := make([]byte, 4) //nolint:gomnd
+
+	binary.NativeEndian.PutUint32(b, v)
+
+	return netlinkAttr{attrType: attrType, data: b}
+}
+
+func netlinkAttrBytes(attrType uint16, b []byte) netlinkAttr {
+	return netlinkAttr{attrType: attrType, data: b}
+}
+
+func netlinkAttrNested(attrType uint16, children ...netlinkAttr) netlinkAttr {
+	return netlinkAttr{attrType: attrType | unix.NLA_F_NESTED, children: children}
+}
+
+// encodeIfInfomsg encodes an ifinfomsg -- the fixed header of all RTM_*LINK messages.
+func encodeIfInfomsg(index int32, flags, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+
+	b[0] = unix.AF_UNSPEC
+
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:12], flags)
+	binary.NativeEndian.PutUint32(b[12:16], change)
+
+	return b
+}
+
+// netlinkRouteRequest sends a single NETLINK_ROUTE request and returns the payloads of any
+// (non-error, non-done) messages received in response. Requests are always sent with
+// NLM_F_REQUEST|NLM_F_ACK in addition to the given flags, so this returns only once the kernel
+// has acknowledged (or failed) the request.
+func netlinkRouteRequest(
+	msgType, flags uint16,
+	body []byte,
+	attrs ...netlinkAttr,
+) ([][]byte, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = unix.Close(fd)
+	}()
+
+	err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attr := range attrs {
+		body = append(body, attr.encode()...)
+	}
+
+	seq := netlinkSeq.Add(1)
+
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:12], seq)
+
+	msg = append(msg, body...)
+
+	err = unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return nil, err
+	}
+
+	var payloads [][]byte
+
+	buf := make([]byte, unix.Getpagesize()*8) //nolint:gomnd
+
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return payloads, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 { //nolint:gomnd
+					return nil, fmt.Errorf("%w: truncated netlink error message", ErrMessage)
+				}
+
+				errno := int32(binary.NativeEndian.Uint32(m.Data[0:4]))
+				if errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+
+				// an ack; dumps are terminated by NLMSG_DONE, everything else by the ack
+				if flags&unix.NLM_F_DUMP != unix.NLM_F_DUMP {
+					return payloads, nil
+				}
+			default:
+				payloads = append(payloads, append([]byte(nil), m.Data...))
+			}
+		}
+	}
+}
+
+// deleteLink deletes the link with the given index.
+func deleteLink(index int) error {
+	_, err := netlinkRouteRequest(unix.RTM_DELLINK, 0, encodeIfInfomsg(int32(index), 0, 0))
+
+	return err
+}
+
+// setLinkCarrier sets the carrier of the link with the given index -- only some drivers (tap and
+// dummy for example, but not veth) support this.
+func setLinkCarrier(index int, up bool) error {
+	var carrier byte
+	if up {
+		carrier = 1
+	}
+
+	_, err := netlinkRouteRequest(
+		unix.RTM_NEWLINK,
+		0,
+		encodeIfInfomsg(int32(index), 0, 0),
+		netlinkAttrBytes(unix.IFLA_CARRIER, []byte{carrier}),
+	)
+
+	return err
+}
+
+// setLinkAdminState sets (or clears) the IFF_UP flag of the link with the given index.
+func setLinkAdminState(index int, up bool) error {
+	var flags uint32
+	if up {
+		flags = unix.IFF_UP
+	}
+
+	_, err := netlinkRouteRequest(
+		unix.RTM_NEWLINK, 0, encodeIfInfomsg(int32(index), flags, unix.IFF_UP),
+	)
+
+	return err
+}
+
+// parseNetlinkAttrList parses the attributes in b (but not any nested attributes) in order, types
+// can repeat (for example alternative names in a property list).
+func parseNetlinkAttrList(b []byte) []netlinkAttr {
+	var attrs []netlinkAttr
+
+	for len(b) >= unix.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		attrType := binary.NativeEndian.Uint16(b[2:4]) &^ unix.NLA_F_NESTED
+
+		if l < unix.SizeofRtAttr || l > len(b) {
+			break
+		}
+
+		attrs = append(attrs, netlinkAttr{attrType: attrType, data: b[unix.SizeofRtAttr:l]})
+
+		if netlinkAlign(l) >= len(b) {
+			break
+		}
+
+		b = b[netlinkAlign(l):]
+	}
+
+	return attrs
+}
+
+// parseNetlinkAttrs parses the (non-nested) attributes in b, returning a map of attribute type to
+// attribute payload -- if a type repeats the last one wins.
+func parseNetlinkAttrs(b []byte) map[uint16][]byte {
+	attrs := map[uint16][]byte{}
+
+	for _, attr := range parseNetlinkAttrList(b) {
+		attrs[attr.attrType] = attr.data
+	}
+
+	return attrs
+}
+
+// netlinkAttrStringValue returns the string payload of an attribute without the null terminator.
+func netlinkAttrStringValue(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
+
+// linkInfo is the subset of a link's (RTM_NEWLINK) attributes that slurpeeth cares about.
+type linkInfo struct {
+	index    int
+	flags    uint32
+	name     string
+	alias    string
+	altNames []string
+	attrs    map[uint16][]byte
+}
+
+func parseLinkInfo(payload []byte) (linkInfo, error) {
+	if len(payload) < unix.SizeofIfInfomsg {
+		return linkInfo{}, fmt.Errorf("%w: truncated link message", ErrMessage)
+	}
+
+	info := linkInfo{
+		index: int(int32(binary.NativeEndian.Uint32(payload[4:8]))),
+		flags: binary.NativeEndian.Uint32(payload[8:12]),
+		attrs: parseNetlinkAttrs(payload[unix.SizeofIfInfomsg:]),
+	}
+
+	info.name = netlinkAttrStringValue(info.attrs[unix.IFLA_IFNAME])
+	info.alias = netlinkAttrStringValue(info.attrs[unix.IFLA_IFALIAS])
+
+	for _, prop := range parseNetlinkAttrList(info.attrs[unix.IFLA_PROP_LIST]) {
+		if prop.attrType == unix.IFLA_ALT_IFNAME {
+			info.altNames = append(info.altNames, netlinkAttrStringValue(prop.data))
+		}
+	}
+
+	return info, nil
+}
+
+// listLinks returns the info for all links in the current network namespace.
+func listLinks() ([]linkInfo, error) {
+	payloads, err := netlinkRouteRequest(
+		unix.RTM_GETLINK,
+		unix.NLM_F_DUMP,
+		encodeIfInfomsg(0, 0, 0),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]linkInfo, 0, len(payloads))
+
+	for _, payload := range payloads {
+		info, err := parseLinkInfo(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		links = append(links, info)
+	}
+
+	return links, nil
+}
+
+// getLink returns the info for the link with the given index.
+func getLink(index int) (linkInfo, error) {
+	payloads, err := netlinkRouteRequest(unix.RTM_GETLINK, 0, encodeIfInfomsg(int32(index), 0, 0))
+	if err != nil {
+		return linkInfo{}, err
+	}
+
+	if len(payloads) == 0 {
+		return linkInfo{}, fmt.Errorf("%w: no link info returned for index %d", ErrMessage, index)
+	}
+
+	return parseLinkInfo(payloads[0])
+}
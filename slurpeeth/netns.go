@@ -0,0 +1,118 @@
+package slurpeeth
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// netnsPath returns the path to the network namespace described by ns. ns may be a pid (in which
+// case the namespace of that process is used), an absolute path (like /proc/<pid>/ns/net or a bind
+// mounted namespace), or the name of a namespace in /var/run/netns (as created by "ip netns").
+func netnsPath(ns string) string {
+	if _, err := strconv.Atoi(ns); err == nil {
+		return fmt.Sprintf("/proc/%s/ns/net", ns)
+	}
+
+	if strings.HasPrefix(ns, "/") {
+		return ns
+	}
+
+	return filepath.Join(NetnsRunDir, ns)
+}
+
+// openNetns opens the network namespace described by ns (see netnsPath). A namespace that does
+// not exist is reported as errInterfaceNotFound -- its interfaces can't exist either (yet?).
+func openNetns(ns string) (*os.File, error) {
+	f, err := os.Open(netnsPath(ns))
+	if err != nil {
+		return nil, netnsError(ns, err)
+	}
+
+	return f, nil
+}
+
+// netnsInode returns the inode of the network namespace described by ns -- a namespace deleted and
+// recreated behind the same name (say, a container restarting) has a new inode.
+func netnsInode(ns string) (uint64, error) {
+	var stat unix.Stat_t
+
+	err := unix.Stat(netnsPath(ns), &stat)
+	if err != nil {
+		return 0, netnsError(ns, err)
+	}
+
+	return stat.Ino, nil
+}
+
+func netnsError(ns string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf(
+			"%w: network namespace %q does not exist (yet?)", errInterfaceNotFound, ns,
+		)
+	}
+
+	return fmt.Errorf("%w: failed opening network namespace %q, error: %w", ErrBind, ns, err)
+}
+
+// runInNetns runs f with the calling goroutine locked to an os thread that has been moved into the
+// network namespace described by ns. Any sockets created in f belong to that namespace and remain
+// there after f returns. If the thread cannot be moved back to its original namespace it is not
+// unlocked, so the go runtime discards it rather than letting other goroutines run in the wrong
+// namespace. If ns is empty f is simply run in the current namespace.
+func runInNetns(ns string, f func() error) error {
+	if ns == "" {
+		return f()
+	}
+
+	target, err := openNetns(ns)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = target.Close()
+	}()
+
+	runtime.LockOSThread()
+
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+
+		return err
+	}
+
+	defer func() {
+		_ = origin.Close()
+	}()
+
+	err = unix.Setns(int(target.Fd()), unix.CLONE_NEWNET)
+	if err != nil {
+		runtime.UnlockOSThread()
+
+		return fmt.Errorf(
+			"%w: failed entering network namespace %q, error: %w", ErrBind, ns, err,
+		)
+	}
+
+	fErr := f()
+
+	err = unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET)
+	if err != nil {
+		return fmt.Errorf(
+			"%w: failed returning from network namespace %q, error: %w", ErrBind, ns, err,
+		)
+	}
+
+	runtime.UnlockOSThread()
+
+	return fErr
+}
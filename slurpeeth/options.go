@@ -1,6 +1,10 @@
 package slurpeeth
 
-import "time"
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
 
 // Option defines an option for the slurpeeth Manager.
 type Option func(m *manager) error
@@ -42,6 +46,36 @@ func WithPort(i uint16) Option {
 	}
 }
 
+// WithAPIAddress sets the address (host:port) the runtime http/json api listens on, an empty
+// address (the default) disables the api.
+func WithAPIAddress(s string) Option {
+	return func(m *manager) error {
+		m.apiAddress = s
+
+		return nil
+	}
+}
+
+// WithCaptureDirectory sets the directory packet captures started via the api are written to --
+// the api only takes file names, so it can not write anywhere else. Without a capture directory
+// the api can only (re)start the captures in the config.
+func WithCaptureDirectory(s string) Option {
+	return func(m *manager) error {
+		if s == "" {
+			return nil
+		}
+
+		dir, err := filepath.Abs(s)
+		if err != nil {
+			return fmt.Errorf("%w: invalid capture directory %q, error: %w", ErrConfig, s, err)
+		}
+
+		m.captureDir = dir
+
+		return nil
+	}
+}
+
 // WithDialTimeout sets the maximum timeout for dial attempts for slurpeeth workers -- this is the
 // maximum amount of time a worker will continue to attempt to dial a destination. 0 indicates that
 // there is no timeout and we'll continually try to dial the connection.
@@ -75,3 +109,76 @@ func WithWorkerRetry(b bool) Option {
 		return nil
 	}
 }
+
+// WithTCPNoDelay sets TCP_NODELAY on tunnel connections. This defaults to true (as is the Go
+// default), setting it to false enables Nagle's algorithm on tunnel connections.
+func WithTCPNoDelay(b bool) Option {
+	return func(m *manager) error {
+		m.tcpOptions.NoDelay = b
+
+		return nil
+	}
+}
+
+// WithTCPUserTimeout sets TCP_USER_TIMEOUT on tunnel connections -- this is the maximum amount of
+// time transmitted data can go unacknowledged before the connection is closed, which lets
+// slurpeeth detect half-dead peers quickly. 0 leaves the kernel default in place.
+func WithTCPUserTimeout(d time.Duration) Option {
+	return func(m *manager) error {
+		m.tcpOptions.UserTimeout = d
+
+		return nil
+	}
+}
+
+// WithTCPKeepAlive enables keepalives on tunnel connections with the given idle time, probe
+// interval and probe count. Any 0 value leaves the kernel default for that setting in place. The
+// kernel takes idle and interval in whole seconds, so they must be at least a second (partial
+// seconds are rounded up).
+func WithTCPKeepAlive(idle, interval time.Duration, count int) Option {
+	return func(m *manager) error {
+		if count < 0 {
+			return fmt.Errorf("%w: keepalive count must not be negative", ErrConfig)
+		}
+
+		for _, d := range []time.Duration{idle, interval} {
+			if d != 0 && d < time.Second {
+				return fmt.Errorf(
+					"%w: keepalive idle and interval must be 0 or at least 1s, got %s",
+					ErrConfig, d,
+				)
+			}
+		}
+
+		m.tcpOptions.KeepAliveIdle = idle
+		m.tcpOptions.KeepAliveInterval = interval
+		m.tcpOptions.KeepAliveCount = count
+
+		return nil
+	}
+}
+
+// WithMultipathTCP enables multipath tcp (MPTCP) for the listener and for destination dials. When
+// the kernel or peer does not support MPTCP slurpeeth falls back to plain TCP.
+func WithMultipathTCP(b bool) Option {
+	return func(m *manager) error {
+		m.tcpOptions.MultipathTCP = b
+
+		return nil
+	}
+}
+
+// WithTCPBufferSizes sets the socket send and receive buffer sizes (in bytes) on tunnel
+// connections. A 0 value leaves the kernel default in place.
+func WithTCPBufferSizes(send, receive int) Option {
+	return func(m *manager) error {
+		if send < 0 || receive < 0 {
+			return fmt.Errorf("%w: buffer sizes must not be negative", ErrConfig)
+		}
+
+		m.tcpOptions.SendBufferSize = send
+		m.tcpOptions.ReceiveBufferSize = receive
+
+		return nil
+	}
+}
@@ -0,0 +1,144 @@
+package slurpeeth
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// interfaceIO is the handle an interface worker reads frames from and writes frames to -- by
+// default this is an AF_PACKET socket bound to an existing interface, but it may also be something
+// like a tap device that slurpeeth created itself.
+type interfaceIO interface {
+	// readFrame blocks until the next frame is available and returns it.
+	readFrame() (Bytes, error)
+	// writeFrame writes the frame b out of the interface.
+	writeFrame(b Bytes) error
+	// close releases the handle (and anything else it owns).
+	close() error
+}
+
+// errOutgoingFrame is returned by readFrame for frames that were transmitted out of the interface
+// (by the host, or by slurpeeth itself) rather than received on it. Packet sockets bound with
+// ETH_P_ALL see both directions, forwarding outgoing frames would re-inject frames we just wrote
+// (or that another segment on the same interface just wrote) back into the tunnel. We check the
+// packet type rather than setting PACKET_IGNORE_OUTGOING so that suppressed frames can be counted.
+var errOutgoingFrame = errors.New("outgoing frame")
+
+// packetSocket is an interfaceIO backed by an AF_PACKET socket bound to an existing interface.
+type packetSocket struct {
+	name    string
+	fd      int
+	details *syscall.SockaddrLinklayer
+}
+
+// newPacketSocket opens a packet socket bound to the interface, with filter (if not nil) attached.
+// The socket is created with protocol 0 so it receives nothing until it is bound -- attaching the
+// filter before binding means no unfiltered frames are ever queued on it.
+func newPacketSocket(name string, ifindex int, filter []unix.SockFilter) (*packetSocket, error) {
+	details := &syscall.SockaddrLinklayer{
+		Protocol: EthPAll,
+		Ifindex:  ifindex,
+	}
+
+	fd, err := syscall.Socket(
+		syscall.AF_PACKET,
+		syscall.SOCK_RAW,
+		0,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter != nil {
+		err = attachSocketFilter(fd, filter)
+		if err != nil {
+			_ = syscall.Close(fd)
+
+			return nil, fmt.Errorf(
+				"%w: failed attaching filter to interface %q, error: %w", ErrBind, name, err,
+			)
+		}
+	}
+
+	err = syscall.Bind(fd, details)
+	if err != nil {
+		closeErr := syscall.Close(fd)
+		if closeErr != nil {
+			log.Printf(
+				"encountered error %q binding to interface %s, and subsequent error %q"+
+					" attempting to close file descriptor",
+				err, name, closeErr,
+			)
+		}
+
+		return nil, err
+	}
+
+	// tell the kernel we want the packet aux data (that has vlan info)
+	err = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, PacketAuxData, 1)
+	if err != nil {
+		log.Printf(
+			"encountered error setting PACKET_AUX_DATA request for socket for"+
+				" interface %s, err: %s",
+			name, err,
+		)
+
+		_ = syscall.Close(fd)
+
+		return nil, err
+	}
+
+	return &packetSocket{
+		name:    name,
+		fd:      fd,
+		details: details,
+	}, nil
+}
+
+func (s *packetSocket) readFrame() (Bytes, error) {
+	data := make([]byte, ReadSize)
+	auxData := make([]byte, syscall.CmsgLen(AuxReadSize))
+
+	readN, auxReadN, _, from, err := syscall.Recvmsg(s.fd, data, auxData, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	linkLayerFrom, ok := from.(*syscall.SockaddrLinklayer)
+	if ok && linkLayerFrom.Pkttype == unix.PACKET_OUTGOING {
+		return nil, errOutgoingFrame
+	}
+
+	data = data[:readN]
+
+	// we have to get the "aux" data from the kernel for our socket -- these socket control
+	// messages hold vlan tag info we may have to re-add back to the data we slurped up.
+	// very useful so post about this stuff since this is all a bit of dark magic!
+	// https://stackoverflow.com/questions/56653023/ \
+	//	reading-vlan-field-of-a-raw-ethernet-packet-in-python
+	return frameWithAuxData(data, auxData[:auxReadN])
+}
+
+// appendTaggedFrame appends frame to dst with a vlan tag (tpid/tci) inserted after the mac
+// addresses -- this is for re-inserting tags the kernel stripped from the frame.
+func appendTaggedFrame(dst, frame Bytes, tpid, tci uint16) Bytes {
+	dst = append(dst, frame[:12]...)
+	dst = binary.BigEndian.AppendUint16(dst, tpid)
+	dst = binary.BigEndian.AppendUint16(dst, tci)
+	dst = append(dst, frame[12:]...)
+
+	return dst
+}
+
+func (s *packetSocket) writeFrame(b Bytes) error {
+	return syscall.Sendto(s.fd, b, 0, s.details)
+}
+
+func (s *packetSocket) close() error {
+	return syscall.Close(s.fd)
+}
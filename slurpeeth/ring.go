@@ -0,0 +1,333 @@
+package slurpeeth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// packetRing is an interfaceIO backed by an AF_PACKET socket with TPACKET_V3 mmap'd rx/tx rings.
+// The kernel fills whole blocks of frames in the rx ring that we walk without any per frame
+// syscalls, and frames are written directly into the tx ring and flushed with a (non-blocking)
+// send.
+type packetRing struct {
+	name  string
+	fd    int
+	ring  []byte
+	rx    []byte
+	tx    []byte
+	rxMu  sync.Mutex
+	txMu  sync.Mutex
+	block int
+	frame int
+
+	// pending holds frames copied out of the last rx block that have not been returned yet, nil
+	// entries are outgoing frames (see errOutgoingFrame).
+	pending []Bytes
+
+	closing atomic.Bool
+}
+
+// newPacketRing sets up a packet ring bound to the interface, with filter (if not nil) attached --
+// like newPacketSocket the socket is only bound once the filter is in place.
+func newPacketRing(name string, ifindex int, filter []unix.SockFilter) (*packetRing, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &packetRing{
+		name: name,
+		fd:   fd,
+	}
+
+	err = r.setup(ifindex, filter)
+	if err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf(
+			"%w: failed setting up packet ring for interface %q, error: %w", ErrBind, name, err,
+		)
+	}
+
+	return r, nil
+}
+
+func (r *packetRing) setup(ifindex int, filter []unix.SockFilter) error {
+	err := unix.SetsockoptInt(r.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3)
+	if err != nil {
+		return err
+	}
+
+	if filter != nil {
+		err = attachSocketFilter(r.fd, filter)
+		if err != nil {
+			return err
+		}
+	}
+
+	// have the kernel skip (and hand back) tx slots holding malformed frames rather than stopping
+	// the ring on them -- this can only be set before the rings are set up
+	err = unix.SetsockoptInt(r.fd, unix.SOL_PACKET, unix.PACKET_LOSS, 1)
+	if err != nil {
+		return err
+	}
+
+	rxReq := &unix.TpacketReq3{
+		Block_size:     RingRxBlockSize,
+		Block_nr:       RingRxBlockCount,
+		Frame_size:     RingRxFrameSize,
+		Frame_nr:       RingRxBlockSize / RingRxFrameSize * RingRxBlockCount,
+		Retire_blk_tov: RingRxBlockTimeoutMs,
+	}
+
+	err = unix.SetsockoptTpacketReq3(r.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, rxReq)
+	if err != nil {
+		return err
+	}
+
+	txReq := &unix.TpacketReq3{
+		Block_size: RingTxBlockSize,
+		Block_nr:   RingTxBlockCount,
+		Frame_size: RingTxFrameSize,
+		Frame_nr:   RingTxBlockSize / RingTxFrameSize * RingTxBlockCount,
+	}
+
+	err = unix.SetsockoptTpacketReq3(r.fd, unix.SOL_PACKET, unix.PACKET_TX_RING, txReq)
+	if err != nil {
+		return err
+	}
+
+	rxSize := RingRxBlockSize * RingRxBlockCount
+	txSize := RingTxBlockSize * RingTxBlockCount
+
+	// rx and tx rings are mapped with a single mmap, rx ring first
+	r.ring, err = unix.Mmap(
+		r.fd, 0, rxSize+txSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_LOCKED,
+	)
+	if err != nil {
+		return err
+	}
+
+	r.rx = r.ring[:rxSize]
+	r.tx = r.ring[rxSize:]
+
+	err = unix.Bind(r.fd, &unix.SockaddrLinklayer{
+		Protocol: EthPAll,
+		Ifindex:  ifindex,
+	})
+	if err != nil {
+		_ = unix.Munmap(r.ring)
+
+		return err
+	}
+
+	return nil
+}
+
+func (r *packetRing) blockHeader(block int) *unix.TpacketHdrV1 {
+	desc := (*unix.TpacketBlockDesc)(unsafe.Pointer(&r.rx[block*RingRxBlockSize]))
+
+	return (*unix.TpacketHdrV1)(unsafe.Pointer(&desc.Hdr[0]))
+}
+
+func (r *packetRing) readFrame() (Bytes, error) {
+	r.rxMu.Lock()
+	defer r.rxMu.Unlock()
+
+	for len(r.pending) == 0 {
+		if r.closing.Load() {
+			return nil, fmt.Errorf("%w: packet ring for %q", os.ErrClosed, r.name)
+		}
+
+		hdr := r.blockHeader(r.block)
+
+		if atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+			// the poll timeout is so that we periodically check if we've been closed
+			_, err := unix.Poll(
+				[]unix.PollFd{{Fd: int32(r.fd), Events: unix.POLLIN | unix.POLLERR}},
+				RingPollTimeoutMs,
+			)
+			if err != nil && !errors.Is(err, unix.EINTR) {
+				return nil, err
+			}
+
+			continue
+		}
+
+		r.consumeBlock(hdr)
+
+		// hand the block back to the kernel and move on to the next
+		atomic.StoreUint32(&hdr.Block_status, unix.TP_STATUS_KERNEL)
+
+		r.block = (r.block + 1) % RingRxBlockCount
+	}
+
+	frame := r.pending[0]
+	r.pending = r.pending[1:]
+
+	if frame == nil {
+		return nil, errOutgoingFrame
+	}
+
+	return frame, nil
+}
+
+func (r *packetRing) consumeBlock(hdr *unix.TpacketHdrV1) {
+	blockStart := r.block * RingRxBlockSize
+	offset := blockStart + int(hdr.Offset_to_first_pkt)
+
+	frameHeaders := make([]*unix.Tpacket3Hdr, 0, hdr.Num_pkts)
+
+	var total int
+
+	for i := uint32(0); i < hdr.Num_pkts; i++ {
+		frameHdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&r.rx[offset]))
+
+		frameHeaders = append(frameHeaders, frameHdr)
+
+		if !ringFrameOutgoing(frameHdr) {
+			total += int(frameHdr.Snaplen) + VlanTagSize
+		}
+
+		offset += int(frameHdr.Next_offset)
+	}
+
+	// one allocation for the whole block, each frame gets a slice of it -- these are handed off
+	// to the rest of the worker so we cant just hand out slices of the ring itself
+	buf := make([]byte, 0, total)
+
+	offset = blockStart + int(hdr.Offset_to_first_pkt)
+
+	for _, frameHdr := range frameHeaders {
+		if ringFrameOutgoing(frameHdr) {
+			r.pending = append(r.pending, nil)
+
+			offset += int(frameHdr.Next_offset)
+
+			continue
+		}
+
+		dataStart := offset + int(frameHdr.Mac)
+		data := r.rx[dataStart : dataStart+int(frameHdr.Snaplen)]
+
+		start := len(buf)
+
+		buf = appendFrameWithTag(
+			buf,
+			data,
+			frameHdr.Status,
+			uint16(frameHdr.Hv1.Vlan_tci),
+			frameHdr.Hv1.Vlan_tpid,
+		)
+
+		r.pending = append(r.pending, buf[start:len(buf):len(buf)])
+
+		offset += int(frameHdr.Next_offset)
+	}
+}
+
+// ringFrameOutgoing returns true if the frame was transmitted out of (rather than received on) the
+// interface -- the frame's sockaddr_ll follows the (aligned) frame header.
+func ringFrameOutgoing(frameHdr *unix.Tpacket3Hdr) bool {
+	sllOffset := uintptr(unix.SizeofTpacket3Hdr+unix.TPACKET_ALIGNMENT-1) &
+		^uintptr(unix.TPACKET_ALIGNMENT-1)
+
+	sll := (*unix.RawSockaddrLinklayer)(unsafe.Add(unsafe.Pointer(frameHdr), sllOffset))
+
+	return sll.Pkttype == unix.PACKET_OUTGOING
+}
+
+func (r *packetRing) writeFrame(b Bytes) error {
+	r.txMu.Lock()
+	defer r.txMu.Unlock()
+
+	if r.closing.Load() {
+		return fmt.Errorf("%w: packet ring for %q", os.ErrClosed, r.name)
+	}
+
+	dataOffset := int(unix.SizeofTpacket3Hdr+unix.TPACKET_ALIGNMENT-1) &
+		^(unix.TPACKET_ALIGNMENT - 1)
+
+	if dataOffset+len(b) > RingTxFrameSize {
+		return fmt.Errorf(
+			"%w: frame of %d bytes too large for tx ring of interface %q",
+			ErrMessage,
+			len(b),
+			r.name,
+		)
+	}
+
+	frameCount := RingTxBlockSize / RingTxFrameSize * RingTxBlockCount
+
+	frameHdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&r.tx[r.frame*RingTxFrameSize]))
+
+	// if the slot is still in use the ring is full -- kick the kernel and wait for it to drain
+	for {
+		status := atomic.LoadUint32(&frameHdr.Status)
+		if status == unix.TP_STATUS_AVAILABLE {
+			break
+		}
+
+		if r.closing.Load() {
+			return fmt.Errorf("%w: packet ring for %q", os.ErrClosed, r.name)
+		}
+
+		if status&unix.TP_STATUS_WRONG_FORMAT != 0 {
+			// the kernel refused the frame we put here earlier (and will never touch the slot
+			// again), reclaim it so the ring does not stall
+			atomic.StoreUint32(&frameHdr.Status, unix.TP_STATUS_AVAILABLE)
+
+			return fmt.Errorf(
+				"%w: tx ring of interface %q rejected a malformed frame", ErrMessage, r.name,
+			)
+		}
+
+		err := unix.Sendto(r.fd, nil, 0, nil)
+		if err != nil && !errors.Is(err, unix.EAGAIN) {
+			return err
+		}
+	}
+
+	copy(r.tx[r.frame*RingTxFrameSize+dataOffset:], b)
+
+	frameHdr.Len = uint32(len(b))
+	frameHdr.Snaplen = uint32(len(b))
+	frameHdr.Next_offset = 0
+
+	atomic.StoreUint32(&frameHdr.Status, unix.TP_STATUS_SEND_REQUEST)
+
+	r.frame = (r.frame + 1) % frameCount
+
+	err := unix.Sendto(r.fd, nil, unix.MSG_DONTWAIT, nil)
+	if err != nil && !errors.Is(err, unix.EAGAIN) {
+		return err
+	}
+
+	return nil
+}
+
+func (r *packetRing) close() error {
+	r.closing.Store(true)
+
+	// wait for any in flight reads/writes to notice we are closing before unmapping the ring out
+	// from under them
+	r.rxMu.Lock()
+	r.txMu.Lock()
+
+	defer r.rxMu.Unlock()
+	defer r.txMu.Unlock()
+
+	err := unix.Munmap(r.ring)
+	if err != nil {
+		log.Printf("ignoring error unmapping packet ring for interface %q, err: %s", r.name, err)
+	}
+
+	return unix.Close(r.fd)
+}
@@ -0,0 +1,470 @@
+package slurpeeth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	scenarioStateRunning   = "running"
+	scenarioStateDone      = "done"
+	scenarioStateCancelled = "cancelled"
+
+	scenarioPollInterval = time.Second
+	scenarioMaxBodySize  = 1 << 20
+)
+
+// Scenario is a timeline of events applied to running segments -- for repeatable link failures.
+type Scenario struct {
+	// Name is the name of the scenario, only used for logging and the api.
+	Name string `yaml:"name"`
+	// Events are the events of the scenario, they are applied in order of their At offsets (events
+	// with the same offset are applied in the order they are listed).
+	Events []ScenarioEvent `yaml:"events"`
+}
+
+// ScenarioEvent is a single event of a Scenario.
+type ScenarioEvent struct {
+	// At is the offset from the start of the scenario the event is applied at.
+	At time.Duration `yaml:"at"`
+	// Segment is the tunnel id of the segment the event applies to.
+	Segment uint16 `yaml:"segment"`
+	// Action is what to do: "impair" sets Impairment (replacing any current impairment), "clear"
+	// clears impairments, "down" sets the segment admin down and "up" sets it admin up again.
+	Action string `yaml:"action"`
+	// Direction is the direction "impair" and "clear" apply to -- "egress", "ingress" or empty for
+	// both.
+	Direction string `yaml:"direction"`
+	// Impairment is the impairment set by "impair".
+	Impairment *Impairment `yaml:"impairment"`
+	// Link is how "down" forces the segment's local interfaces down: "carrier", "admin" or empty
+	// to only stop forwarding. "up" restores whatever was forced.
+	Link string `yaml:"link"`
+}
+
+func (e *ScenarioEvent) validate() error {
+	switch e.Direction {
+	case "", "egress", "ingress":
+	default:
+		return fmt.Errorf("%w: unknown direction %q", ErrConfig, e.Direction)
+	}
+
+	switch e.Action {
+	case ScenarioActionImpair:
+		if e.Impairment == nil {
+			return fmt.Errorf("%w: impair event has no impairment", ErrConfig)
+		}
+
+		return e.Impairment.validate()
+	case ScenarioActionDown:
+		return validateLinkDown(e.Link)
+	case ScenarioActionClear, ScenarioActionUp:
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown scenario action %q", ErrConfig, e.Action)
+	}
+}
+
+func (e *ScenarioEvent) String() string {
+	s := fmt.Sprintf("at %s %s tunnel id %d", e.At, e.Action, e.Segment)
+
+	if e.Direction != "" {
+		s += " " + e.Direction
+	}
+
+	if e.Link != "" {
+		s += " link " + e.Link
+	}
+
+	if e.Impairment != nil {
+		encoded, _ := json.Marshal(e.Impairment)
+
+		s += " " + string(encoded)
+	}
+
+	return s
+}
+
+// scenarioRun is a scenario running in the manager.
+type scenarioRun struct {
+	id       int
+	scenario Scenario
+	started  time.Time
+	cancel   context.CancelFunc
+
+	mu      sync.Mutex
+	state   string
+	applied int
+	errors  []string
+}
+
+// scenarioStatus is a scenario run as reported by the api.
+type scenarioStatus struct {
+	ID      int      `json:"id"`
+	Name    string   `json:"name"`
+	State   string   `json:"state"`
+	Started string   `json:"started"`
+	Events  int      `json:"events"`
+	Applied int      `json:"applied"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+func (r *scenarioRun) status() scenarioStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return scenarioStatus{
+		ID:      r.id,
+		Name:    r.scenario.Name,
+		State:   r.state,
+		Started: r.started.Format(time.RFC3339),
+		Events:  len(r.scenario.Events),
+		Applied: r.applied,
+		Errors:  append([]string(nil), r.errors...),
+	}
+}
+
+// startScenario validates and starts running scenario, it runs until all events are applied, it
+// is cancelled or the manager exits.
+func (m *manager) startScenario(scenario Scenario) (*scenarioRun, error) {
+	if len(scenario.Events) == 0 {
+		return nil, fmt.Errorf("%w: scenario has no events", ErrConfig)
+	}
+
+	for idx := range scenario.Events {
+		err := scenario.Events[idx].validate()
+		if err != nil {
+			return nil, fmt.Errorf("%w (event %d)", err, idx)
+		}
+	}
+
+	sort.SliceStable(scenario.Events, func(i, j int) bool {
+		return scenario.Events[i].At < scenario.Events[j].At
+	})
+
+	ctx, cancel := context.WithCancel(m.ctx)
+
+	m.scenariosLock.Lock()
+
+	m.scenarioCount++
+
+	run := &scenarioRun{
+		id:       m.scenarioCount,
+		scenario: scenario,
+		started:  time.Now(),
+		cancel:   cancel,
+		state:    scenarioStateRunning,
+	}
+
+	m.scenarios[run.id] = run
+
+	m.scenariosLock.Unlock()
+
+	log.Printf(
+		"starting scenario %d %q with %d events", run.id, scenario.Name, len(scenario.Events),
+	)
+
+	go m.runScenario(ctx, run)
+
+	return run, nil
+}
+
+func (m *manager) runScenario(ctx context.Context, run *scenarioRun) {
+	state := scenarioStateDone
+
+	for idx := range run.scenario.Events {
+		event := &run.scenario.Events[idx]
+
+		timer := time.NewTimer(time.Until(run.started.Add(event.At)))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			state = scenarioStateCancelled
+		case <-timer.C:
+		}
+
+		if state == scenarioStateCancelled {
+			break
+		}
+
+		err := m.applyScenarioEvent(event)
+
+		run.mu.Lock()
+
+		run.applied++
+
+		if err != nil {
+			log.Printf("scenario %d event %s failed, err: %s", run.id, event, err)
+
+			run.errors = append(run.errors, fmt.Sprintf("%s: %s", event, err))
+		} else {
+			log.Printf("scenario %d applied event %s", run.id, event)
+		}
+
+		run.mu.Unlock()
+	}
+
+	run.mu.Lock()
+	run.state = state
+	run.mu.Unlock()
+
+	run.cancel()
+
+	log.Printf("scenario %d %q %s", run.id, run.scenario.Name, state)
+}
+
+func (m *manager) applyScenarioEvent(event *ScenarioEvent) error {
+	worker, ok := m.getWorker(event.Segment)
+	if !ok {
+		return fmt.Errorf("no segment with id %d", event.Segment)
+	}
+
+	impairers := []*impairer{worker.egressImpairer, worker.ingressImpairer}
+
+	switch event.Direction {
+	case "egress":
+		impairers = impairers[:1]
+	case "ingress":
+		impairers = impairers[1:]
+	}
+
+	switch event.Action {
+	case ScenarioActionImpair:
+		for _, i := range impairers {
+			i.set(*event.Impairment)
+		}
+	case ScenarioActionClear:
+		for _, i := range impairers {
+			i.set(Impairment{})
+		}
+	case ScenarioActionDown:
+		return worker.setAdminDown(event.Link)
+	case ScenarioActionUp:
+		return worker.setAdminUp()
+	}
+
+	return nil
+}
+
+func (m *manager) getScenario(id int) (*scenarioRun, bool) {
+	m.scenariosLock.Lock()
+	defer m.scenariosLock.Unlock()
+
+	run, ok := m.scenarios[id]
+
+	return run, ok
+}
+
+// handleScenarios handles "/scenarios" -- GET lists scenario runs, POST starts a scenario from a
+// yaml (or json) body.
+func (m *manager) handleScenarios(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		m.scenariosLock.Lock()
+
+		runs := make([]*scenarioRun, 0, len(m.scenarios))
+
+		for _, run := range m.scenarios {
+			runs = append(runs, run)
+		}
+
+		m.scenariosLock.Unlock()
+
+		statuses := make([]scenarioStatus, len(runs))
+
+		for idx, run := range runs {
+			statuses[idx] = run.status()
+		}
+
+		sort.Slice(statuses, func(i, j int) bool {
+			return statuses[i].ID < statuses[j].ID
+		})
+
+		writeAPIResponse(w, http.StatusOK, statuses)
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, scenarioMaxBodySize))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+
+			return
+		}
+
+		var scenario Scenario
+
+		err = yaml.Unmarshal(body, &scenario)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+
+			return
+		}
+
+		run, err := m.startScenario(scenario)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+
+			return
+		}
+
+		writeAPIResponse(w, http.StatusCreated, run.status())
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleScenario handles "/scenarios/<id>" -- GET returns and DELETE cancels a scenario run.
+func (m *manager) handleScenario(w http.ResponseWriter, r *http.Request) {
+	rawID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/scenarios/"), "/")
+
+	id, err := strconv.Atoi(rawID)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid scenario id %q", rawID))
+
+		return
+	}
+
+	run, ok := m.getScenario(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no scenario with id %d", id))
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		run.cancel()
+
+		log.Printf("cancelling scenario %d via the api", id)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+
+		return
+	}
+
+	writeAPIResponse(w, http.StatusOK, run.status())
+}
+
+// RunScenario runs the scenario file at path on the slurpeeth instance whose api listens on
+// apiAddress, returning once the scenario is done. The scenario is cancelled if this process is
+// interrupted.
+func RunScenario(apiAddress, path string) error {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// parse locally too, so a broken file fails before we bother the instance
+	var scenario Scenario
+
+	err = yaml.Unmarshal(body, &scenario)
+	if err != nil {
+		return fmt.Errorf("%w: failed parsing scenario file, error: %w", ErrConfig, err)
+	}
+
+	ctx, cancel := SignalHandledContext(log.Printf)
+	defer cancel()
+
+	baseURL := "http://" + apiAddress + "/scenarios"
+
+	var status scenarioStatus
+
+	err = scenarioRequest(
+		context.Background(), http.MethodPost, baseURL, bytes.NewReader(body), &status,
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("started scenario %d %q with %d events", status.ID, status.Name, status.Events)
+
+	statusURL := fmt.Sprintf("%s/%d", baseURL, status.ID)
+
+	applied := 0
+
+	ticker := time.NewTicker(scenarioPollInterval)
+	defer ticker.Stop()
+
+	for status.State == scenarioStateRunning {
+		select {
+		case <-ctx.Done():
+			log.Printf("cancelling scenario %d", status.ID)
+
+			return scenarioRequest(
+				context.Background(), http.MethodDelete, statusURL, nil, &status,
+			)
+		case <-ticker.C:
+		}
+
+		err = scenarioRequest(ctx, http.MethodGet, statusURL, nil, &status)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+
+			return err
+		}
+
+		if status.Applied != applied {
+			applied = status.Applied
+
+			log.Printf("scenario %d applied %d/%d events", status.ID, applied, status.Events)
+		}
+	}
+
+	log.Printf("scenario %d %s", status.ID, status.State)
+
+	if len(status.Errors) > 0 {
+		return fmt.Errorf(
+			"%w: scenario %d had failed events: %s",
+			ErrConfig,
+			status.ID,
+			strings.Join(status.Errors, "; "),
+		)
+	}
+
+	return nil
+}
+
+func scenarioRequest(
+	ctx context.Context,
+	method, url string,
+	body io.Reader,
+	status *scenarioStatus,
+) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: failed calling slurpeeth api, error: %w", ErrConnectivity, err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var apiErr apiError
+
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+
+		return fmt.Errorf("%w: slurpeeth api returned %q", ErrConfig, apiErr.Error)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(status)
+}
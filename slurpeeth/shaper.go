@@ -0,0 +1,403 @@
+package slurpeeth
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// shapingMinBurst is the smallest default burst -- enough for a couple of full size frames.
+	shapingMinBurst = 2 * 1514
+	// shapingBurstTime is how much of the rate the default burst holds, this has to comfortably
+	// exceed timer granularity for high rates to be reached.
+	shapingBurstTime = 10 * time.Millisecond
+
+	// redWeight is the weight of the current queue length in red's moving average queue length.
+	redWeight = 0.002
+	// redDefaultProbability is the default max drop probability (percent) for red.
+	redDefaultProbability = 10
+)
+
+// Shaping holds the bandwidth emulation settings of a segment. Every output of the segment (each
+// local interface and each destination, however many streams it has) behaves like a link of the
+// given rate -- frames are queued and paced out per a token bucket, and dropped when the queue is
+// full (or early, with red).
+type Shaping struct {
+	// Rate is the link rate, for example "10mbit" or "1gbit" -- "bit", "kbit", "mbit" and "gbit"
+	// suffixes are supported, a plain number is bits per second.
+	Rate string `yaml:"rate"`
+	// Burst is the token bucket size in bytes, defaults to 10ms worth of Rate (but at least a
+	// couple of full size frames).
+	Burst int `yaml:"burst"`
+	// QueueLimit is the queue size in frames, defaults to 1000.
+	QueueLimit int `yaml:"queue-limit"`
+	// Drop is the queue drop policy: "tail" (the default) or "red".
+	Drop string `yaml:"drop"`
+	// RED holds the red settings when Drop is "red".
+	RED *REDOptions `yaml:"red"`
+}
+
+// REDOptions holds random early detection settings.
+type REDOptions struct {
+	// Min is the average queue length (frames) red starts dropping at, defaults to a quarter of
+	// the queue limit.
+	Min int `yaml:"min"`
+	// Max is the average queue length (frames) from which all frames are dropped, defaults to
+	// three quarters of the queue limit.
+	Max int `yaml:"max"`
+	// Probability is the drop probability (percent) at Max, defaults to 10.
+	Probability float64 `yaml:"probability"`
+}
+
+// parseRate parses a rate like "10mbit" into bytes per second.
+func parseRate(s string) (float64, error) {
+	rate := strings.ToLower(strings.TrimSpace(s))
+
+	multiplier := 1.0
+
+	for _, suffix := range []struct {
+		suffix     string
+		multiplier float64
+	}{
+		{"gbit", 1e9},
+		{"mbit", 1e6},
+		{"kbit", 1e3},
+		{"bit", 1},
+	} {
+		if strings.HasSuffix(rate, suffix.suffix) {
+			rate = strings.TrimSuffix(rate, suffix.suffix)
+			multiplier = suffix.multiplier
+
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(rate, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("%w: invalid rate %q", ErrConfig, s)
+	}
+
+	return value * multiplier / 8, nil //nolint:gomnd
+}
+
+// shaper is a token bucket shaped queue in front of one output of a segment.
+type shaper struct {
+	name string
+
+	rate  float64
+	burst float64
+	limit int
+	red   *REDOptions
+
+	mu     sync.Mutex
+	queue  []*Message
+	bytes  int
+	avg    float64
+	notify chan struct{}
+	done   chan struct{}
+	closed bool
+	rand   *rand.Rand
+
+	deliver func(*Message)
+
+	sent      atomic.Uint64
+	tailDrops atomic.Uint64
+	redDrops  atomic.Uint64
+}
+
+func newShaper(name string, shaping *Shaping, deliver func(*Message)) (*shaper, error) {
+	rate, err := parseRate(shaping.Rate)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &shaper{
+		name:    name,
+		rate:    rate,
+		burst:   float64(shaping.Burst),
+		limit:   shaping.QueueLimit,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())), //nolint:gosec
+		deliver: deliver,
+	}
+
+	if s.burst <= 0 {
+		s.burst = math.Max(shapingMinBurst, rate*shapingBurstTime.Seconds())
+	}
+
+	if s.limit <= 0 {
+		s.limit = ShapingQueueLimit
+	}
+
+	switch shaping.Drop {
+	case "", ShapingDropTail:
+	case ShapingDropRED:
+		red := REDOptions{}
+		if shaping.RED != nil {
+			red = *shaping.RED
+		}
+
+		if red.Min <= 0 {
+			red.Min = s.limit / 4 //nolint:gomnd
+		}
+
+		if red.Max <= 0 {
+			red.Max = s.limit * 3 / 4 //nolint:gomnd
+		}
+
+		if red.Probability <= 0 {
+			red.Probability = redDefaultProbability
+		}
+
+		if red.Min >= red.Max || red.Max > s.limit || red.Probability > percent {
+			return nil, fmt.Errorf(
+				"%w: invalid red settings, need min < max <= queue limit and probability <= 100",
+				ErrConfig,
+			)
+		}
+
+		s.red = &red
+	default:
+		return nil, fmt.Errorf("%w: unsupported drop policy %q", ErrConfig, shaping.Drop)
+	}
+
+	return s, nil
+}
+
+// enqueue queues msg to be sent once the rate allows, or drops it if the queue is full (or red
+// decides to drop it).
+func (s *shaper) enqueue(msg *Message) {
+	s.mu.Lock()
+
+	if s.closed {
+		s.mu.Unlock()
+
+		return
+	}
+
+	if s.red != nil {
+		s.avg = (1-redWeight)*s.avg + redWeight*float64(len(s.queue))
+
+		if s.redDrop() {
+			s.mu.Unlock()
+
+			s.redDrops.Add(1)
+
+			return
+		}
+	}
+
+	if len(s.queue) >= s.limit {
+		s.mu.Unlock()
+
+		s.tailDrops.Add(1)
+
+		return
+	}
+
+	s.queue = append(s.queue, msg)
+	s.bytes += len(msg.Body)
+
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// redDrop decides if red drops the next frame, s.mu must be held.
+func (s *shaper) redDrop() bool {
+	switch {
+	case s.avg < float64(s.red.Min):
+		return false
+	case s.avg >= float64(s.red.Max):
+		return true
+	}
+
+	p := s.red.Probability / percent * (s.avg - float64(s.red.Min)) /
+		float64(s.red.Max-s.red.Min)
+
+	return s.rand.Float64() < p
+}
+
+func (s *shaper) run() {
+	tokens := s.burst
+	last := time.Now()
+
+	for {
+		s.mu.Lock()
+
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+
+			select {
+			case <-s.done:
+				return
+			case <-s.notify:
+			}
+
+			continue
+		}
+
+		msg := s.queue[0]
+
+		s.mu.Unlock()
+
+		now := time.Now()
+		tokens = math.Min(s.burst, tokens+now.Sub(last).Seconds()*s.rate)
+		last = now
+
+		// frames larger than the bucket go out when the bucket is full
+		needed := math.Min(float64(len(msg.Body)), s.burst)
+
+		if tokens < needed {
+			wait := time.Duration((needed - tokens) / s.rate * float64(time.Second))
+
+			select {
+			case <-s.done:
+				return
+			case <-time.After(wait):
+			}
+
+			continue
+		}
+
+		tokens -= float64(len(msg.Body))
+
+		s.mu.Lock()
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.bytes -= len(msg.Body)
+		s.mu.Unlock()
+
+		s.deliver(msg)
+
+		s.sent.Add(1)
+	}
+}
+
+func (s *shaper) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	s.queue = nil
+	s.bytes = 0
+
+	close(s.done)
+}
+
+// shaperStats are the counters of a shaper as reported by the api.
+type shaperStats struct {
+	Name       string `json:"name"`
+	QueueDepth int    `json:"queueDepth"`
+	QueueBytes int    `json:"queueBytes"`
+	Sent       uint64 `json:"sent"`
+	TailDrops  uint64 `json:"tailDrops"`
+	REDDrops   uint64 `json:"redDrops"`
+}
+
+func (s *shaper) stats() shaperStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return shaperStats{
+		Name:       s.name,
+		QueueDepth: len(s.queue),
+		QueueBytes: s.bytes,
+		Sent:       s.sent.Load(),
+		TailDrops:  s.tailDrops.Load(),
+		REDDrops:   s.redDrops.Load(),
+	}
+}
+
+// createShapers creates (and starts) a shaper for each of the worker's interfaces and destinations
+// -- a destination's shaper feeds all of its streams, so that its rate is that of the whole link.
+func (w *Worker) createShapers() error {
+	for idx := range w.interfaces {
+		idx := idx
+
+		s, err := newShaper(
+			fmt.Sprintf("interface %s", w.interfaces[idx].name),
+			w.segment.Shaping,
+			func(msg *Message) { w.interfaces[idx].sendChan <- msg },
+		)
+		if err != nil {
+			return err
+		}
+
+		w.interfaces[idx].shaper = s
+	}
+
+	w.destinationShapers = make([]*shaper, len(w.destinationGroups))
+
+	for groupIdx := range w.destinationGroups {
+		groupIdx := groupIdx
+
+		s, err := newShaper(
+			fmt.Sprintf("destination %s", w.destinationGroupNames[groupIdx]),
+			w.segment.Shaping,
+			func(msg *Message) { w.sendToDestinationStream(groupIdx, msg) },
+		)
+		if err != nil {
+			return err
+		}
+
+		w.destinationShapers[groupIdx] = s
+	}
+
+	for _, s := range w.shapers() {
+		go s.run()
+	}
+
+	return nil
+}
+
+// shapers returns all shapers of the worker, empty unless the segment is shaped.
+func (w *Worker) shapers() []*shaper {
+	var shapers []*shaper
+
+	for idx := range w.interfaces {
+		if w.interfaces[idx].shaper != nil {
+			shapers = append(shapers, w.interfaces[idx].shaper)
+		}
+	}
+
+	for _, s := range w.destinationShapers {
+		if s != nil {
+			shapers = append(shapers, s)
+		}
+	}
+
+	return shapers
+}
+
+func (w *Worker) closeShapers() {
+	for _, s := range w.shapers() {
+		s.close()
+	}
+}
+
+func (w *Worker) shaperStats() []shaperStats {
+	shapers := w.shapers()
+
+	stats := make([]shaperStats, len(shapers))
+
+	for idx, s := range shapers {
+		stats[idx] = s.stats()
+	}
+
+	return stats
+}
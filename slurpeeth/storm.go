@@ -0,0 +1,234 @@
+package slurpeeth
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StormControl holds the storm control settings of a segment -- thresholds (in frames per second,
+// across all members of the segment, 0 for no threshold) above which frames of a class are
+// dropped.
+type StormControl struct {
+	// Broadcast is the broadcast frames per second threshold.
+	Broadcast uint64 `yaml:"broadcast"`
+	// Multicast is the multicast (non broadcast group address) frames per second threshold.
+	Multicast uint64 `yaml:"multicast"`
+	// UnknownUnicast is the threshold for unicast frames to macs that are not in the mac table, so
+	// it is only valid for segments in switch mode.
+	UnknownUnicast uint64 `yaml:"unknown-unicast"`
+	// Action is what happens when a threshold is exceeded: "drop" (the default) drops frames over
+	// the threshold, "err-disable" pauses the whole segment.
+	Action string `yaml:"action"`
+	// Recovery is how long an err-disabled segment stays paused before resuming on its own, if
+	// unset the segment stays paused until it is set admin up via the api.
+	Recovery time.Duration `yaml:"recovery"`
+}
+
+func (c *StormControl) validate(mode string) error {
+	switch c.Action {
+	case "", StormControlActionDrop, StormControlActionErrDisable:
+	default:
+		return fmt.Errorf("%w: unsupported storm control action %q", ErrConfig, c.Action)
+	}
+
+	if c.UnknownUnicast != 0 && mode != SegmentModeSwitch {
+		return fmt.Errorf("%w: unknown unicast storm control requires switch mode", ErrConfig)
+	}
+
+	if c.Recovery < 0 {
+		return fmt.Errorf("%w: storm control recovery can not be negative", ErrConfig)
+	}
+
+	return nil
+}
+
+type stormClass int
+
+const (
+	stormClassBroadcast stormClass = iota
+	stormClassMulticast
+	stormClassUnknownUnicast
+	stormClassCount
+)
+
+func (c stormClass) String() string {
+	switch c {
+	case stormClassBroadcast:
+		return "broadcast"
+	case stormClassMulticast:
+		return "multicast"
+	case stormClassUnknownUnicast:
+		return "unknown-unicast"
+	default:
+		return "unknown"
+	}
+}
+
+// stormMeter counts the frames of one class in one second windows, like switches do.
+type stormMeter struct {
+	threshold uint64
+
+	mu          sync.Mutex
+	windowStart time.Time
+	count       uint64
+
+	drops atomic.Uint64
+}
+
+// exceeded counts a frame and returns true if it is over the threshold, first is true for the
+// first frame over the threshold in the current window.
+func (m *stormMeter) exceeded(now time.Time) (exceeded, first bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.windowStart) >= time.Second {
+		m.windowStart = now
+		m.count = 0
+	}
+
+	m.count++
+
+	if m.count <= m.threshold {
+		return false, false
+	}
+
+	m.drops.Add(1)
+
+	return true, m.count == m.threshold+1
+}
+
+// stormControl applies a StormControl to the frames flooded by a segment.
+type stormControl struct {
+	config StormControl
+	meters [stormClassCount]*stormMeter
+}
+
+func newStormControl(config *StormControl) *stormControl {
+	c := &stormControl{config: *config}
+
+	for class, threshold := range [stormClassCount]uint64{
+		stormClassBroadcast:      config.Broadcast,
+		stormClassMulticast:      config.Multicast,
+		stormClassUnknownUnicast: config.UnknownUnicast,
+	} {
+		if threshold != 0 {
+			c.meters[class] = &stormMeter{threshold: threshold}
+		}
+	}
+
+	return c
+}
+
+func classifyStorm(dst [macSize]byte, known bool) (stormClass, bool) {
+	switch {
+	case dst == [macSize]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}:
+		return stormClassBroadcast, true
+	case dst[0]&1 != 0:
+		return stormClassMulticast, true
+	case !known:
+		return stormClassUnknownUnicast, true
+	default:
+		return 0, false
+	}
+}
+
+// stormControlled returns true if a frame to dst should be dropped by storm control, known is
+// whether dst is in the mac table (always false in hub mode, where there is no unknown unicast
+// threshold anyway).
+func (w *Worker) stormControlled(dst [macSize]byte, known bool) bool {
+	if w.stormControl == nil {
+		return false
+	}
+
+	class, ok := classifyStorm(dst, known)
+	if !ok {
+		return false
+	}
+
+	meter := w.stormControl.meters[class]
+	if meter == nil {
+		return false
+	}
+
+	exceeded, first := meter.exceeded(time.Now())
+	if !exceeded {
+		return false
+	}
+
+	if w.stormControl.config.Action == StormControlActionErrDisable {
+		reason := fmt.Sprintf("%s storm (over %d pps)", class, meter.threshold)
+
+		if w.pause(reason) {
+			log.Printf(
+				"!!! STORM CONTROL: %s on tunnel id %d, segment ERR-DISABLED, all frames are being"+
+					" dropped until it is resumed !!!",
+				reason,
+				w.segment.ID,
+			)
+
+			if w.stormControl.config.Recovery > 0 {
+				time.AfterFunc(w.stormControl.config.Recovery, func() {
+					if w.resumeIf(reason) {
+						log.Printf(
+							"storm control recovery elapsed, resumed tunnel id %d",
+							w.segment.ID,
+						)
+					}
+				})
+			}
+		}
+
+		return true
+	}
+
+	if first {
+		log.Printf(
+			"storm control: %s storm on tunnel id %d, dropping %s frames over %d pps",
+			class, w.segment.ID, class, meter.threshold,
+		)
+	}
+
+	return true
+}
+
+// stormControlStatus is the storm control state of a segment as reported by the api.
+type stormControlStatus struct {
+	Action string                  `json:"action"`
+	Drops  map[string]stormDropped `json:"drops"`
+}
+
+type stormDropped struct {
+	Threshold uint64 `json:"threshold"`
+	Drops     uint64 `json:"drops"`
+}
+
+func (w *Worker) stormControlStatus() *stormControlStatus {
+	if w.stormControl == nil {
+		return nil
+	}
+
+	status := &stormControlStatus{
+		Action: w.stormControl.config.Action,
+		Drops:  map[string]stormDropped{},
+	}
+
+	if status.Action == "" {
+		status.Action = StormControlActionDrop
+	}
+
+	for class, meter := range w.stormControl.meters {
+		if meter == nil {
+			continue
+		}
+
+		status.Drops[stormClass(class).String()] = stormDropped{
+			Threshold: meter.threshold,
+			Drops:     meter.drops.Load(),
+		}
+	}
+
+	return status
+}
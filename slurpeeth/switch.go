@@ -0,0 +1,339 @@
+package slurpeeth
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const macSize = 6
+
+const (
+	// destinationResolveTTL is how long the resolved ips of a destination hostname are used
+	// before resolving it again, destinationResolveRetry how long a failed lookup is cached.
+	destinationResolveTTL   = time.Minute
+	destinationResolveRetry = 5 * time.Second
+)
+
+// macMember is the segment member a mac was learned on -- either one of the worker's local
+// interfaces or a remote sender.
+type macMember struct {
+	// sender is the sender id of the member (for local interfaces the interface's sender id).
+	sender string
+	// iface is the index of the local interface the mac was learned on, -1 for remote members.
+	iface int
+	// destinationGroup is the index of the destination group a remote member is reached through,
+	// -1 if we could not tell (in which case frames for the member go to all destinations).
+	destinationGroup int
+}
+
+type macEntry struct {
+	member   macMember
+	lastSeen time.Time
+}
+
+// macTable is the mac address table of a segment in switch mode.
+type macTable struct {
+	mu        sync.Mutex
+	ageTime   time.Duration
+	entries   map[[macSize]byte]macEntry
+	lastSweep time.Time
+}
+
+func newMACTable(ageTime time.Duration) *macTable {
+	return &macTable{
+		ageTime:   ageTime,
+		entries:   map[[macSize]byte]macEntry{},
+		lastSweep: time.Now(),
+	}
+}
+
+// learn records that mac was last seen on member. Group (broadcast/multicast) source macs are
+// bogus and never learned.
+func (t *macTable) learn(mac [macSize]byte, member macMember) {
+	if mac[0]&1 != 0 {
+		return
+	}
+
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.entries[mac] = macEntry{member: member, lastSeen: now}
+
+	if now.Sub(t.lastSweep) > t.ageTime {
+		t.sweep(now)
+	}
+}
+
+// lookup returns the member mac was learned on, ok is false for unknown (or aged out) macs.
+func (t *macTable) lookup(mac [macSize]byte) (member macMember, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[mac]
+	if !ok || time.Since(entry.lastSeen) > t.ageTime {
+		return macMember{}, false
+	}
+
+	return entry.member, true
+}
+
+// sweep removes aged out entries, t.mu must be held.
+func (t *macTable) sweep(now time.Time) {
+	for mac, entry := range t.entries {
+		if now.Sub(entry.lastSeen) > t.ageTime {
+			delete(t.entries, mac)
+		}
+	}
+
+	t.lastSweep = now
+}
+
+// macTableEntry is a mac table entry as reported by the api.
+type macTableEntry struct {
+	MAC       string `json:"mac"`
+	Sender    string `json:"sender"`
+	Interface string `json:"interface,omitempty"`
+	Remote    bool   `json:"remote"`
+	// Destination is the destination a remote mac is reached through, empty if unknown (frames
+	// for the mac go to all destinations).
+	Destination string `json:"destination,omitempty"`
+	Age         string `json:"age"`
+}
+
+func (w *Worker) macTableEntries() []macTableEntry {
+	if w.macTable == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	w.macTable.mu.Lock()
+	defer w.macTable.mu.Unlock()
+
+	w.macTable.sweep(now)
+
+	entries := make([]macTableEntry, 0, len(w.macTable.entries))
+
+	for mac, entry := range w.macTable.entries {
+		tableEntry := macTableEntry{
+			MAC:    net.HardwareAddr(mac[:]).String(),
+			Sender: entry.member.sender,
+			Remote: entry.member.iface < 0,
+			Age:    now.Sub(entry.lastSeen).Truncate(time.Millisecond).String(),
+		}
+
+		if entry.member.iface >= 0 {
+			tableEntry.Interface = w.interfaces[entry.member.iface].name
+		}
+
+		if entry.member.destinationGroup >= 0 {
+			tableEntry.Destination = w.destinationGroupAddresses[entry.member.destinationGroup]
+		}
+
+		entries = append(entries, tableEntry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].MAC < entries[j].MAC
+	})
+
+	return entries
+}
+
+func frameMACs(frame Bytes) (dst, src [macSize]byte, ok bool) {
+	if len(frame) < 2*macSize {
+		return dst, src, false
+	}
+
+	copy(dst[:], frame[:macSize])
+	copy(src[:], frame[macSize:2*macSize])
+
+	return dst, src, true
+}
+
+// forwardFromInterface forwards a message read from local interface idx -- in hub mode to every
+// other member of the segment, in switch mode only to the member the destination mac was learned
+// on (if it is known).
+func (w *Worker) forwardFromInterface(idx int, msg *Message) {
+	if w.paused.Load() {
+		return
+	}
+
+	dst, src, ok := frameMACs(msg.Body)
+	if !ok {
+		w.flood(msg)
+
+		return
+	}
+
+	if w.macTable == nil {
+		if !w.stormControlled(dst, false) {
+			w.flood(msg)
+		}
+
+		return
+	}
+
+	w.macTable.learn(src, macMember{
+		sender:           w.interfaces[idx].sender,
+		iface:            idx,
+		destinationGroup: -1,
+	})
+
+	member, known := w.macTable.lookup(dst)
+
+	if w.stormControlled(dst, known) {
+		return
+	}
+
+	switch {
+	case !known || dst[0]&1 != 0:
+		w.flood(msg)
+	case member.iface == idx:
+		// the destination is on the interface the frame came from, nothing to do
+	case member.iface >= 0:
+		w.sendToInterface(member.iface, msg)
+	case member.destinationGroup >= 0:
+		w.sendToDestinationGroup(member.destinationGroup, msg)
+	default:
+		w.destinationFanoutChan <- msg
+	}
+}
+
+// forwardFromRemote forwards a message received from a remote slurpeeth to the local interfaces
+// -- in hub mode to all of them, in switch mode only to the interface the destination mac was
+// learned on (if it is known). Frames are never forwarded from one remote to another.
+func (w *Worker) forwardFromRemote(msg *Message) {
+	if w.paused.Load() {
+		return
+	}
+
+	dst, src, ok := frameMACs(msg.Body)
+	if !ok {
+		w.relayToInterfaces(msg)
+
+		return
+	}
+
+	if w.macTable == nil {
+		if !w.stormControlled(dst, false) {
+			w.relayToInterfaces(msg)
+		}
+
+		return
+	}
+
+	w.macTable.learn(src, macMember{
+		sender:           msg.Header.Sender,
+		iface:            -1,
+		destinationGroup: w.destinationGroupFor(msg.remote),
+	})
+
+	member, known := w.macTable.lookup(dst)
+
+	if w.stormControlled(dst, known) {
+		return
+	}
+
+	switch {
+	case !known || dst[0]&1 != 0:
+		w.relayToInterfaces(msg)
+	case member.iface >= 0:
+		w.sendToInterface(member.iface, msg)
+	}
+}
+
+// flood sends msg to all of the worker's other interfaces and all of its destinations.
+func (w *Worker) flood(msg *Message) {
+	w.relayToInterfaces(msg)
+
+	w.destinationFanoutChan <- msg
+}
+
+// destinationGroupFor returns the index of the destination group whose address matches the
+// address a message was received from, or -1 if none match.
+func (w *Worker) destinationGroupFor(remote net.Addr) int {
+	tcpAddr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return -1
+	}
+
+	for groupIdx, address := range w.destinationGroupAddresses {
+		for _, ip := range w.resolveDestination(address) {
+			if ip.Equal(tcpAddr.IP) {
+				return groupIdx
+			}
+		}
+	}
+
+	return -1
+}
+
+// resolvedDestination is the cached lookup of a destination hostname.
+type resolvedDestination struct {
+	ips       []net.IP
+	expires   time.Time
+	resolving bool
+}
+
+// resolveDestination returns the ips of a destination address. This is called while forwarding
+// frames so it never blocks on dns -- hostnames are resolved in the background and cached, until
+// the first lookup completes (or while lookups fail) the last known ips (or none) are returned.
+func (w *Worker) resolveDestination(address string) []net.IP {
+	if address == "" {
+		// reached via a command, nothing to resolve
+		return nil
+	}
+
+	ip := net.ParseIP(address)
+	if ip != nil {
+		return []net.IP{ip}
+	}
+
+	w.resolvedDestinationsLock.Lock()
+	defer w.resolvedDestinationsLock.Unlock()
+
+	resolved, ok := w.resolvedDestinations[address]
+	if !ok {
+		resolved = &resolvedDestination{}
+
+		w.resolvedDestinations[address] = resolved
+	}
+
+	if !resolved.resolving && time.Now().After(resolved.expires) {
+		resolved.resolving = true
+
+		go w.lookupDestination(address, resolved)
+	}
+
+	return resolved.ips
+}
+
+func (w *Worker) lookupDestination(address string, resolved *resolvedDestination) {
+	ips, err := net.LookupIP(address)
+
+	w.resolvedDestinationsLock.Lock()
+	defer w.resolvedDestinationsLock.Unlock()
+
+	resolved.resolving = false
+
+	if err != nil {
+		// keep whatever we had, and try again soon
+		log.Printf(
+			"failed resolving destination %q for tunnel id %d, err: %s",
+			address, w.segment.ID, err,
+		)
+
+		resolved.expires = time.Now().Add(destinationResolveRetry)
+
+		return
+	}
+
+	resolved.ips = ips
+	resolved.expires = time.Now().Add(destinationResolveTTL)
+}
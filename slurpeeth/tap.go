@@ -0,0 +1,113 @@
+package slurpeeth
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// tapDevice is an interfaceIO backed by a tap device that slurpeeth created. The device is not
+// persistent, so it is removed by the kernel as soon as the tap file descriptor is closed.
+type tapDevice struct {
+	name string
+	file *os.File
+}
+
+func newTapDevice(name string) (*tapDevice, error) {
+	fd, err := unix.Open(TunDevicePath, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"%w: failed opening %q for tap %q, error: %w", ErrBind, TunDevicePath, name, err,
+		)
+	}
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("%w: invalid tap name %q, error: %w", ErrBind, name, err)
+	}
+
+	ifr.SetUint16(unix.IFF_TAP | unix.IFF_NO_PI)
+
+	err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr)
+	if err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("%w: failed creating tap %q, error: %w", ErrBind, name, err)
+	}
+
+	err = setInterfaceUp(name)
+	if err != nil {
+		_ = unix.Close(fd)
+
+		return nil, err
+	}
+
+	// non-blocking so the file is managed by the go runtime poller, this way closing the file
+	// unblocks any pending reads rather than leaving them hanging forever
+	err = unix.SetNonblock(fd, true)
+	if err != nil {
+		_ = unix.Close(fd)
+
+		return nil, err
+	}
+
+	return &tapDevice{
+		name: name,
+		file: os.NewFile(uintptr(fd), TunDevicePath),
+	}, nil
+}
+
+func (t *tapDevice) readFrame() (Bytes, error) {
+	data := make([]byte, ReadSize)
+
+	readN, err := t.file.Read(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data[:readN], nil
+}
+
+func (t *tapDevice) writeFrame(b Bytes) error {
+	_, err := t.file.Write(b)
+
+	return err
+}
+
+func (t *tapDevice) close() error {
+	return t.file.Close()
+}
+
+// setInterfaceUp sets the IFF_UP flag on the named interface.
+func setInterfaceUp(name string) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = unix.Close(fd)
+	}()
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return err
+	}
+
+	err = unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr)
+	if err != nil {
+		return fmt.Errorf("%w: failed reading flags for %q, error: %w", ErrBind, name, err)
+	}
+
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+
+	err = unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+	if err != nil {
+		return fmt.Errorf("%w: failed setting %q up, error: %w", ErrBind, name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package slurpeeth
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TCPOptions holds socket level tuning applied to tunnel connections -- both the connections
+// workers dial to their destinations and the connections accepted by the listener. Zero values
+// (other than NoDelay which is always applied) leave the kernel/Go defaults in place.
+type TCPOptions struct {
+	// NoDelay sets TCP_NODELAY (disables Nagle's algorithm) when true; Go enables this by default
+	// so this is true unless explicitly disabled.
+	NoDelay bool
+	// UserTimeout sets TCP_USER_TIMEOUT -- the maximum time transmitted data may remain
+	// unacknowledged before the kernel forcibly closes the connection.
+	UserTimeout time.Duration
+	// KeepAliveIdle is the idle time before the first keepalive probe is sent (TCP_KEEPIDLE).
+	KeepAliveIdle time.Duration
+	// KeepAliveInterval is the time between keepalive probes (TCP_KEEPINTVL).
+	KeepAliveInterval time.Duration
+	// KeepAliveCount is the number of unanswered probes before the connection is dropped
+	// (TCP_KEEPCNT).
+	KeepAliveCount int
+	// SendBufferSize is the socket send buffer size in bytes (SO_SNDBUF).
+	SendBufferSize int
+	// ReceiveBufferSize is the socket receive buffer size in bytes (SO_RCVBUF).
+	ReceiveBufferSize int
+	// MultipathTCP enables MPTCP on the listener and on destination dials. If the kernel (or the
+	// peer) does not support MPTCP connections transparently fall back to plain TCP. Whether a
+	// destination connection actually negotiated MPTCP is reported per destination in the segment
+	// status of the api, for accepted connections it is only logged.
+	MultipathTCP bool
+}
+
+func (o *TCPOptions) dialer() *net.Dialer {
+	d := &net.Dialer{}
+
+	d.SetMultipathTCP(o.MultipathTCP)
+
+	return d
+}
+
+func (o *TCPOptions) listenConfig() *net.ListenConfig {
+	lc := &net.ListenConfig{}
+
+	lc.SetMultipathTCP(o.MultipathTCP)
+
+	return lc
+}
+
+// multipathStatus returns a string describing whether the connection negotiated MPTCP, this is
+// only used for logging and status reporting so the result is always something printable.
+func (o *TCPOptions) multipathStatus(conn net.Conn) string {
+	if !o.MultipathTCP {
+		return "disabled"
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "not applicable"
+	}
+
+	negotiated, err := tcpConn.MultipathTCP()
+	if err != nil {
+		return fmt.Sprintf("unknown (%s)", err)
+	}
+
+	if negotiated {
+		return "negotiated"
+	}
+
+	return "fallback to tcp"
+}
+
+func (o *TCPOptions) keepAliveEnabled() bool {
+	return o.KeepAliveIdle > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0
+}
+
+// apply sets the options in o on the given connection. Connections that are not TCP connections
+// are left as-is.
+func (o *TCPOptions) apply(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	err := tcpConn.SetNoDelay(o.NoDelay)
+	if err != nil {
+		return fmt.Errorf("%w: failed setting TCP_NODELAY, error: %w", ErrConnectivity, err)
+	}
+
+	if o.SendBufferSize > 0 {
+		err = tcpConn.SetWriteBuffer(o.SendBufferSize)
+		if err != nil {
+			return fmt.Errorf("%w: failed setting SO_SNDBUF, error: %w", ErrConnectivity, err)
+		}
+	}
+
+	if o.ReceiveBufferSize > 0 {
+		err = tcpConn.SetReadBuffer(o.ReceiveBufferSize)
+		if err != nil {
+			return fmt.Errorf("%w: failed setting SO_RCVBUF, error: %w", ErrConnectivity, err)
+		}
+	}
+
+	if o.keepAliveEnabled() {
+		err = tcpConn.SetKeepAlive(true)
+		if err != nil {
+			return fmt.Errorf("%w: failed enabling keepalive, error: %w", ErrConnectivity, err)
+		}
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockOptErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		sockOptErr = o.applyRaw(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockOptErr
+}
+
+// ceilSeconds returns d in whole seconds, rounded up so that a partial second is never silently
+// turned into 0 (which would leave the kernel default in place).
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+func (o *TCPOptions) applyRaw(fd int) error {
+	intOpts := []struct {
+		name  string
+		opt   int
+		value int
+	}{
+		{
+			name:  "TCP_USER_TIMEOUT",
+			opt:   unix.TCP_USER_TIMEOUT,
+			value: int(o.UserTimeout.Milliseconds()),
+		},
+		{
+			name:  "TCP_KEEPIDLE",
+			opt:   unix.TCP_KEEPIDLE,
+			value: ceilSeconds(o.KeepAliveIdle),
+		},
+		{
+			name:  "TCP_KEEPINTVL",
+			opt:   unix.TCP_KEEPINTVL,
+			value: ceilSeconds(o.KeepAliveInterval),
+		},
+		{
+			name:  "TCP_KEEPCNT",
+			opt:   unix.TCP_KEEPCNT,
+			value: o.KeepAliveCount,
+		},
+	}
+
+	for _, intOpt := range intOpts {
+		if intOpt.value <= 0 {
+			continue
+		}
+
+		err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, intOpt.opt, intOpt.value)
+		if err != nil {
+			return fmt.Errorf(
+				"%w: failed setting %s to %d, error: %w",
+				ErrConnectivity,
+				intOpt.name,
+				intOpt.value,
+				err,
+			)
+		}
+	}
+
+	return nil
+}
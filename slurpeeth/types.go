@@ -1,5 +1,11 @@
 package slurpeeth
 
+import (
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
 // Config holds the yaml configuration used for slurpeeth.
 type Config struct {
 	// Segments is a list of Segments -- basically point-to-point connections.
@@ -7,10 +13,10 @@ type Config struct {
 }
 
 // Segment holds information about a "segment" -- that is a collection of interfaces and
-// destinations. Note that *all traffic from interfaces* is sent directly to destinations -- that
-// means that for local traffic it goes "out" to a TCP connection to the destination(s) listed, but
-// on of those destinations can be localhost. In this way we can connect multiple interfaces locally
-// -- probably mostly useful for testing as otherwise you'd just connect veths.
+// destinations. Note that *all traffic from interfaces* is sent directly to destinations (over a
+// TCP connection) as well as to the segment's other local interfaces -- local interfaces are
+// bridged in process, so there is no need for a localhost destination to connect multiple
+// interfaces locally (localhost destinations are ignored).
 type Segment struct {
 	// Name is an optional friendly name for the Segment.
 	Name string `yaml:"name"`
@@ -22,9 +28,234 @@ type Segment struct {
 	// of the Destinations in the Destination field. If no interface(s) are specified it is assumed
 	// that this slurpeeth instance is basically a bridge/proxy node that will just forward traffic
 	// to destinations based on tunnel id.
-	Interfaces []string `yaml:"interfaces"`
+	Interfaces []Interface `yaml:"interfaces"`
 	// Destinations is a listing of destination to send traffic from this Segment to.
-	Destinations []string `yaml:"destinations"`
+	Destinations []Destination `yaml:"destinations"`
+	// Mode is how frames are forwarded between the members (interfaces and destinations) of the
+	// segment. "hub" (the default) floods every frame to every member. "switch" learns source macs
+	// per member (local interface or remote sender) and sends unicast frames only to the member
+	// the destination mac was learned on -- unknown unicast, broadcast and multicast frames are
+	// still flooded.
+	Mode string `yaml:"mode"`
+	// MACAgeTime is how long learned macs are kept in switch mode, defaults to 5 minutes.
+	MACAgeTime time.Duration `yaml:"mac-age-time"`
+	// Impairments emulates a bad link (delay, jitter, loss, duplication, reordering, corruption)
+	// per direction of the segment. Impairments can also be changed at runtime via the api.
+	Impairments *Impairments `yaml:"impairments"`
+	// Shaping emulates the bandwidth of a link -- every output of the segment (local interface or
+	// destination) is paced to the configured rate with a bounded queue.
+	Shaping *Shaping `yaml:"shaping"`
+	// StormControl drops (or pauses the segment on) broadcast/multicast/unknown unicast frames
+	// over per second thresholds, so a loop in a lab can not saturate every tunnel.
+	StormControl *StormControl `yaml:"storm-control"`
+	// PropagateLinkState sends the state of the segment's (existing) local interfaces to the
+	// segment's peers, and forces the local interfaces down while the peer's end is down --
+	// "carrier" or "admin" say how interfaces are forced down, empty disables propagation. All
+	// ends of the segment must run a slurpeeth that understands link state messages.
+	PropagateLinkState string `yaml:"propagate-link-state"`
+	// Capture writes every frame passing through the segment to (rotating) pcapng files, the
+	// capture can also be started and stopped at runtime via the api.
+	Capture *Capture `yaml:"capture"`
+}
+
+// Interface is a local interface a Segment reads frames from and writes frames to. In the config
+// file an interface can be a plain string (the name or alias of the interface) or a mapping that
+// includes the name and any additional interface settings.
+type Interface struct {
+	// Name is the name (or alias/altname) of the interface.
+	Name string `yaml:"name"`
+	// Create, if set, tells slurpeeth to create (and own) the interface rather than binding to an
+	// existing one. Supported values are "tap" and "veth". For "tap" slurpeeth creates a tap device
+	// with the given name, brings it up, and reads/writes frames via the tap file descriptor. For
+	// "veth" slurpeeth creates a veth pair (see Veth), and binds to the end named Name. In both
+	// cases the interface(s) are removed when the segment is shutdown.
+	Create string `yaml:"create"`
+	// Veth holds the settings for the peer end of the pair when Create is "veth".
+	Veth *VethOptions `yaml:"veth"`
+	// Namespace, if set, is the network namespace the interface lives in -- a pid (of a container
+	// for example), a path (like /proc/<pid>/ns/net), or the name of a namespace in
+	// /var/run/netns. The interface is looked up and its socket is created inside this namespace,
+	// so slurpeeth can attach directly to container interfaces. A namespace that does not exist
+	// (yet) is waited on, and one that is replaced (the container restarted) is rebound.
+	Namespace string `yaml:"namespace"`
+	// Backend selects how frames are read from and written to the interface: "packet" (the
+	// default) uses an AF_PACKET socket with a syscall per frame, "ring" uses an AF_PACKET socket
+	// with TPACKET_V3 mmap'd rx/tx rings which cuts syscalls and allocations on high rate
+	// segments, and "xdp" uses AF_XDP sockets with an xdp program redirecting all frames from the
+	// interface to slurpeeth (bypassing the host stack entirely). If the requested backend cannot
+	// be setup slurpeeth falls back to "packet". Ignored for tap devices.
+	Backend string `yaml:"backend"`
+	// Promisc puts the interface in promiscuous mode (via a PACKET_MR_PROMISC membership) while
+	// slurpeeth is bound to it, so frames for other macs are delivered on drivers/bridges that
+	// would otherwise filter them.
+	Promisc bool `yaml:"promisc"`
+	// AllMulti makes the interface receive all multicast frames (via a PACKET_MR_ALLMULTI
+	// membership) while slurpeeth is bound to it.
+	AllMulti bool `yaml:"allmulti"`
+	// Filter is a classic bpf filter attached to the interface's socket, only frames matching the
+	// filter are read from the interface -- for example to keep the host's own LLDP or IPv6 ND
+	// traffic out of a segment. Not supported for tap devices or the "xdp" backend.
+	Filter *Filter `yaml:"filter"`
+	// Vlan maps a single vlan of a trunk interface to the segment -- only frames tagged with the
+	// vlan id are read from the interface. The same interface can be used in many segments (each
+	// with their own vlan), so one port can feed many per-vlan tunnels. Not supported for tap
+	// devices or the "xdp" backend.
+	Vlan *VlanOptions `yaml:"vlan"`
+}
+
+// VlanOptions holds the vlan demux settings of an interface. In the config file this can be a
+// plain vlan id (which pops and pushes the tag, like an access port) or a mapping.
+type VlanOptions struct {
+	// ID is the 802.1Q vlan id (1-4094) of the segment on the trunk interface.
+	ID int `yaml:"id"`
+	// Pop removes the (outer) vlan tag from frames read from the interface before they are sent
+	// through the tunnel.
+	Pop bool `yaml:"pop"`
+	// Push adds a vlan tag with ID to frames before they are written to the interface.
+	Push bool `yaml:"push"`
+}
+
+// UnmarshalYAML allows VlanOptions to be expressed as either a plain vlan id or as a mapping.
+func (v *VlanOptions) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		err := node.Decode(&v.ID)
+		if err != nil {
+			return err
+		}
+
+		v.Pop = true
+		v.Push = true
+
+		return nil
+	}
+
+	type rawVlanOptions VlanOptions
+
+	var raw rawVlanOptions
+
+	err := node.Decode(&raw)
+	if err != nil {
+		return err
+	}
+
+	*v = VlanOptions(raw)
+
+	return nil
+}
+
+// Filter is a classic bpf socket filter. In the config file a filter can be a plain string (an
+// expression) or a mapping with either an expression or raw instructions.
+type Filter struct {
+	// Expression is a tcpdump-like filter expression, frames matching the expression are kept.
+	// Supported primitives are "ether proto <type>", "ether src|dst|host <mac>", "vlan [id]",
+	// "ip proto <protocol>", and the shorthands "ip", "ip6", "arp", "lldp", "icmp", "icmp6",
+	// "tcp", "udp" and "sctp"; primitives are combined with "and", "or", "not" and parentheses.
+	// For example: "not lldp and not icmp6".
+	Expression string `yaml:"expression"`
+	// Instructions are raw classic bpf instructions, each is [code, jt, jf, k] -- the format
+	// "tcpdump -dd" outputs.
+	Instructions [][]uint32 `yaml:"instructions"`
+}
+
+// UnmarshalYAML allows a Filter to be expressed as either a plain expression string or as a
+// mapping.
+func (f *Filter) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		f.Expression = node.Value
+
+		return nil
+	}
+
+	type rawFilter Filter
+
+	var raw rawFilter
+
+	err := node.Decode(&raw)
+	if err != nil {
+		return err
+	}
+
+	*f = Filter(raw)
+
+	return nil
+}
+
+// VethOptions holds the settings for the peer end of a veth pair slurpeeth creates.
+type VethOptions struct {
+	// Peer is the name of the peer end of the pair, this is the name the interface has in the
+	// target namespace (for example "eth1" in a container).
+	Peer string `yaml:"peer"`
+	// Namespace is the network namespace the peer end is moved into; this can be a pid, a path
+	// (like /proc/<pid>/ns/net), or the name of a namespace in /var/run/netns. If unset the peer
+	// is left in slurpeeth's namespace.
+	Namespace string `yaml:"namespace"`
+	// MTU is the mtu of both ends of the pair, 0 leaves the kernel default in place.
+	MTU int `yaml:"mtu"`
+	// MAC is the mac address of the peer end of the pair, if unset the kernel assigns one.
+	MAC string `yaml:"mac"`
+}
+
+// UnmarshalYAML allows an Interface to be expressed as either a plain name string or as a mapping.
+func (i *Interface) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		i.Name = node.Value
+
+		return nil
+	}
+
+	type rawInterface Interface
+
+	var raw rawInterface
+
+	err := node.Decode(&raw)
+	if err != nil {
+		return err
+	}
+
+	*i = Interface(raw)
+
+	return nil
+}
+
+// Destination is a remote slurpeeth instance a Segment sends traffic to. In the config file a
+// destination can be a plain string (the address of the destination) or a mapping that includes
+// the address and any additional destination settings.
+type Destination struct {
+	// Address is the address (or hostname) of the destination. When Command is set this is
+	// optional, and is only used for substituting "%h" in the command.
+	Address string `yaml:"address"`
+	// Command, if set, is a command (executed with /bin/sh, like OpenSSH's ProxyCommand) whose
+	// stdin/stdout is used as the tunnel connection instead of dialing Address directly -- for
+	// example "ssh jumphost nc %h %p". "%h" is replaced with Address and "%p" with the slurpeeth
+	// port.
+	Command string `yaml:"command"`
+	// Streams is the number of parallel TCP connections to open to this destination. Frames are
+	// distributed across the streams by hashing the inner flow so that each flow stays in order.
+	// 0 or 1 means a single connection.
+	Streams int `yaml:"streams"`
+}
+
+// UnmarshalYAML allows a Destination to be expressed as either a plain address string or as a
+// mapping.
+func (d *Destination) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		d.Address = node.Value
+
+		return nil
+	}
+
+	type rawDestination Destination
+
+	var raw rawDestination
+
+	err := node.Decode(&raw)
+	if err != nil {
+		return err
+	}
+
+	*d = Destination(raw)
+
+	return nil
 }
 
 // Bytes is a slice of bytes.
@@ -36,6 +267,8 @@ type destinationError struct {
 	err  error
 }
 
+// frameAuxData is the kernel's struct tpacket_auxdata -- the PACKET_AUXDATA control message that
+// comes with each frame read from a packet socket.
 type frameAuxData struct {
 	status   uint32
 	len      uint32
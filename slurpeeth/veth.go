@@ -0,0 +1,168 @@
+package slurpeeth
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// vethPair is an interfaceIO for a veth pair that slurpeeth created -- frames are read/written via
+// a packet socket bound to the host end of the pair, and the pair is deleted when closed.
+type vethPair struct {
+	*packetSocket
+	ifindex int
+	// namespace is the namespace the host end of the pair lives in, this is empty unless the
+	// interface itself is configured with a namespace.
+	namespace string
+}
+
+// newVethPair creates a veth pair and binds to the host end of it (with filter, if not nil,
+// attached). It must be called from within namespace (if namespace is not empty), namespace is
+// only stored so the pair can be deleted from the correct namespace later.
+func newVethPair(
+	name, namespace string,
+	options *VethOptions,
+	filter []unix.SockFilter,
+) (*vethPair, error) {
+	peerAttrs := []netlinkAttr{
+		netlinkAttrString(unix.IFLA_IFNAME, options.Peer),
+	}
+
+	hostAttrs := []netlinkAttr{
+		netlinkAttrString(unix.IFLA_IFNAME, name),
+	}
+
+	if options.MTU > 0 {
+		peerAttrs = append(peerAttrs, netlinkAttrUint32(unix.IFLA_MTU, uint32(options.MTU)))
+		hostAttrs = append(hostAttrs, netlinkAttrUint32(unix.IFLA_MTU, uint32(options.MTU)))
+	}
+
+	if options.MAC != "" {
+		mac, err := net.ParseMAC(options.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid mac for veth %q, error: %w", ErrConfig, name, err)
+		}
+
+		peerAttrs = append(peerAttrs, netlinkAttrBytes(unix.IFLA_ADDRESS, mac))
+	}
+
+	if options.Namespace != "" {
+		ns, err := openNetns(options.Namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			_ = ns.Close()
+		}()
+
+		peerAttrs = append(peerAttrs, netlinkAttrUint32(unix.IFLA_NET_NS_FD, uint32(ns.Fd())))
+	}
+
+	// the peer info is an ifinfomsg followed by the peer's attributes
+	peerInfo := encodeIfInfomsg(0, 0, 0)
+
+	for _, attr := range peerAttrs {
+		peerInfo = append(peerInfo, attr.encode()...)
+	}
+
+	hostAttrs = append(
+		hostAttrs,
+		netlinkAttrNested(
+			unix.IFLA_LINKINFO,
+			netlinkAttrString(unix.IFLA_INFO_KIND, "veth"),
+			netlinkAttrNested(
+				unix.IFLA_INFO_DATA,
+				netlinkAttrBytes(vethInfoPeer, peerInfo),
+			),
+		),
+	)
+
+	_, err := netlinkRouteRequest(
+		unix.RTM_NEWLINK,
+		unix.NLM_F_CREATE|unix.NLM_F_EXCL,
+		encodeIfInfomsg(0, 0, 0),
+		hostAttrs...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"%w: failed creating veth pair %q <-> %q, error: %w",
+			ErrBind,
+			name,
+			options.Peer,
+			err,
+		)
+	}
+
+	log.Printf(
+		"created veth pair %q <-> %q (peer namespace %q)", name, options.Peer, options.Namespace,
+	)
+
+	v, err := bindVethPair(name, namespace, options, filter)
+	if err != nil {
+		// clean up after ourselves, nothing else will
+		hostInterface, lookupErr := net.InterfaceByName(name)
+		if lookupErr == nil {
+			_ = deleteLink(hostInterface.Index)
+		}
+
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func bindVethPair(
+	name, namespace string,
+	options *VethOptions,
+	filter []unix.SockFilter,
+) (*vethPair, error) {
+	hostInterface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed finding veth %q, error: %w", ErrBind, name, err)
+	}
+
+	err = setInterfaceUp(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = runInNetns(options.Namespace, func() error {
+		return setInterfaceUp(options.Peer)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newPacketSocket(name, hostInterface.Index, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vethPair{
+		packetSocket: s,
+		ifindex:      hostInterface.Index,
+		namespace:    namespace,
+	}, nil
+}
+
+func (v *vethPair) close() error {
+	err := v.packetSocket.close()
+	if err != nil {
+		log.Printf("ignoring error closing socket for veth %q, err: %s", v.name, err)
+	}
+
+	// deleting one end of the pair deletes the other end as well
+	err = runInNetns(v.namespace, func() error {
+		return deleteLink(v.ifindex)
+	})
+	if err != nil {
+		return fmt.Errorf("%w: failed deleting veth %q, error: %w", ErrBind, v.name, err)
+	}
+
+	log.Printf("deleted veth pair %q", v.name)
+
+	return nil
+}
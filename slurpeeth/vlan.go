@@ -0,0 +1,122 @@
+package slurpeeth
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// vlanIDMax is the largest valid 802.1Q vlan id.
+	vlanIDMax = 4094
+	// etherTypeOffset is the offset of the (outer) ethertype/tpid in a frame.
+	etherTypeOffset = 12
+	// frameAuxDataSize is the size of struct tpacket_auxdata.
+	frameAuxDataSize = 20
+)
+
+// parseFrameAuxData parses the payload of a PACKET_AUXDATA control message.
+func parseFrameAuxData(b []byte) (frameAuxData, error) {
+	if len(b) < frameAuxDataSize {
+		return frameAuxData{}, fmt.Errorf(
+			"%w: truncated packet aux data, got %d bytes", ErrMessage, len(b),
+		)
+	}
+
+	return frameAuxData{
+		status:   binary.NativeEndian.Uint32(b[0:4]),
+		len:      binary.NativeEndian.Uint32(b[4:8]),
+		snapLen:  binary.NativeEndian.Uint32(b[8:12]),
+		mac:      binary.NativeEndian.Uint16(b[12:14]),
+		net:      binary.NativeEndian.Uint16(b[14:16]),
+		vlanTCI:  binary.NativeEndian.Uint16(b[16:18]),
+		vlanTPID: binary.NativeEndian.Uint16(b[18:20]),
+	}, nil
+}
+
+// frameWithAuxData returns frame with the vlan tag the kernel stripped from it re-inserted, per
+// the PACKET_AUXDATA control message in controlData (frame is returned as-is if there is none, or
+// if no tag was stripped).
+func frameWithAuxData(frame Bytes, controlData []byte) (Bytes, error) {
+	controlMsgs, err := unix.ParseSocketControlMessage(controlData)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"%w: failed procesing socket control message(s), error: %w", ErrMessage, err,
+		)
+	}
+
+	for _, controlMsg := range controlMsgs {
+		if controlMsg.Header.Level != unix.SOL_PACKET ||
+			controlMsg.Header.Type != PacketAuxData {
+			continue
+		}
+
+		parsedAuxData, err := parseFrameAuxData(controlMsg.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		if parsedAuxData.status&unix.TP_STATUS_VLAN_VALID != 0 {
+			frame = appendFrameWithTag(
+				make([]byte, 0, len(frame)+VlanTagSize),
+				frame,
+				parsedAuxData.status,
+				parsedAuxData.vlanTCI,
+				parsedAuxData.vlanTPID,
+			)
+		}
+	}
+
+	return frame, nil
+}
+
+// appendFrameWithTag appends frame to dst, re-inserting the vlan tag the kernel stripped from the
+// frame (if it stripped one). This follows the kernel's status flags exactly: a tag was stripped
+// only if TP_STATUS_VLAN_VALID is set -- the tci alone can not tell us, a priority tagged frame
+// on vlan 0 has a tci of zero -- and the tpid is only valid if TP_STATUS_VLAN_TPID_VALID is set,
+// otherwise the tag was an 802.1Q tag. The kernel only ever strips the outermost tag, any inner
+// (QinQ) tags are still in the frame, so inserting the stripped tag in front of them restores the
+// original stack.
+func appendFrameWithTag(dst, frame Bytes, status uint32, tci, tpid uint16) Bytes {
+	if status&unix.TP_STATUS_VLAN_VALID == 0 || len(frame) < etherTypeOffset {
+		return append(dst, frame...)
+	}
+
+	if status&unix.TP_STATUS_VLAN_TPID_VALID == 0 {
+		tpid = etherTypeDot1Q
+	}
+
+	return appendTaggedFrame(dst, frame, tpid, tci)
+}
+
+// outerVlanID returns the vlan id of the outermost tag of frame, ok is false if the frame is not
+// tagged.
+func outerVlanID(frame Bytes) (id int, ok bool) {
+	if len(frame) < etherTypeOffset+VlanTagSize+2 {
+		return 0, false
+	}
+
+	tpid := binary.BigEndian.Uint16(frame[etherTypeOffset:])
+	if tpid != etherTypeDot1Q && tpid != etherTypeDot1AD {
+		return 0, false
+	}
+
+	return int(binary.BigEndian.Uint16(frame[etherTypeOffset+2:]) & vlanIDMask), true
+}
+
+// popVlanTag returns frame without its outermost vlan tag -- the frame is modified in place (the
+// mac addresses are shifted over the tag).
+func popVlanTag(frame Bytes) Bytes {
+	copy(frame[VlanTagSize:], frame[:etherTypeOffset])
+
+	return frame[VlanTagSize:]
+}
+
+// pushVlanTag returns a copy of frame with an 802.1Q tag for vlan id pushed on as the outermost
+// tag, frame itself is left alone since it may be written to other interfaces as well.
+func pushVlanTag(frame Bytes, id int) Bytes {
+	return appendTaggedFrame(
+		make(Bytes, 0, len(frame)+VlanTagSize), frame, etherTypeDot1Q, uint16(id),
+	)
+}
@@ -0,0 +1,178 @@
+package slurpeeth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// the control messages below were recorded from a packet socket on one end of a veth pair (on
+// linux/amd64, so native endian is little endian), with the "sent" frames written to the other
+// end -- the kernel strips the outer tag on receive and reports it in the PACKET_AUXDATA message.
+const (
+	auxDataPayload = "08004500001c000000004011000001020304050607080000000000080000"
+	auxDataMacs    = "0200000000bb02000000000a"
+)
+
+func skipUnlessLittleEndian(t *testing.T) {
+	t.Helper()
+
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("recorded control messages are little endian")
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex %q, err: %s", s, err)
+	}
+
+	return b
+}
+
+func TestFrameWithAuxData(t *testing.T) {
+	skipUnlessLittleEndian(t)
+
+	cases := []struct {
+		name        string
+		frame       string
+		controlData string
+		expected    string
+	}{
+		{
+			name:  "priority-tag-vlan-0",
+			frame: auxDataMacs + auxDataPayload,
+			controlData: "24000000000000000701000008000000" +
+				"510000002a0000002a00000000000e000000008100000000",
+			expected: auxDataMacs + "81000000" + auxDataPayload,
+		},
+		{
+			name:  "priority-tag-vlan-0-pcp-5",
+			frame: auxDataMacs + auxDataPayload,
+			controlData: "24000000000000000701000008000000" +
+				"510000002a0000002a00000000000e0000a0008100000000",
+			expected: auxDataMacs + "8100a000" + auxDataPayload,
+		},
+		{
+			name:  "dot1ad-tpid-valid",
+			frame: auxDataMacs + auxDataPayload,
+			controlData: "24000000000000000701000008000000" +
+				"510000002a0000002a00000000000e006400a88800000000",
+			expected: auxDataMacs + "88a80064" + auxDataPayload,
+		},
+		{
+			// the dot1ad blob with TP_STATUS_VLAN_TPID_VALID cleared and no tpid, as older kernels
+			// report it -- the tag must have been 802.1Q
+			name:  "tpid-not-valid",
+			frame: auxDataMacs + auxDataPayload,
+			controlData: "24000000000000000701000008000000" +
+				"110000002a0000002a00000000000e006400000000000000",
+			expected: auxDataMacs + "81000064" + auxDataPayload,
+		},
+		{
+			name:  "qinq-inner-tag-in-frame",
+			frame: auxDataMacs + "8100000a" + auxDataPayload,
+			controlData: "24000000000000000701000008000000" +
+				"510000002e0000002e00000000000e006400a88800000000",
+			expected: auxDataMacs + "88a80064" + "8100000a" + auxDataPayload,
+		},
+		{
+			name:  "untagged-tci-0",
+			frame: auxDataMacs + auxDataPayload,
+			controlData: "24000000000000000701000008000000" +
+				"010000002a0000002a00000000000e000000000000000000",
+			expected: auxDataMacs + auxDataPayload,
+		},
+		{
+			name:     "no-control-message",
+			frame:    auxDataMacs + auxDataPayload,
+			expected: auxDataMacs + auxDataPayload,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := frameWithAuxData(
+				mustDecodeHex(t, tc.frame), mustDecodeHex(t, tc.controlData),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			expected := mustDecodeHex(t, tc.expected)
+
+			if !bytes.Equal(actual, expected) {
+				t.Fatalf("expected frame\n%x\ngot\n%x", expected, actual)
+			}
+		})
+	}
+}
+
+func TestFrameWithAuxDataInvalid(t *testing.T) {
+	skipUnlessLittleEndian(t)
+
+	cases := []struct {
+		name        string
+		controlData string
+	}{
+		{
+			// a PACKET_AUXDATA message with only 8 bytes of tpacket_auxdata
+			name:        "short-aux-data",
+			controlData: "18000000000000000701000008000000" + "510000002a000000",
+		},
+		{
+			// a cmsg header claiming far more data than there is
+			name:        "garbage",
+			controlData: "ff00000000000000070100000800000051000000",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := frameWithAuxData(
+				mustDecodeHex(t, auxDataMacs+auxDataPayload), mustDecodeHex(t, tc.controlData),
+			)
+			if !errors.Is(err, ErrMessage) {
+				t.Fatalf("expected ErrMessage, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseFrameAuxData(t *testing.T) {
+	skipUnlessLittleEndian(t)
+
+	// the data of the dot1ad control message above
+	parsed, err := parseFrameAuxData(
+		mustDecodeHex(t, "510000002a0000002a00000000000e006400a888"),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := frameAuxData{
+		status:   unix.TP_STATUS_USER | unix.TP_STATUS_VLAN_VALID | unix.TP_STATUS_VLAN_TPID_VALID,
+		len:      42,
+		snapLen:  42,
+		mac:      0,
+		net:      14,
+		vlanTCI:  100,
+		vlanTPID: etherTypeDot1AD,
+	}
+
+	if parsed != expected {
+		t.Fatalf("expected %+v, got %+v", expected, parsed)
+	}
+
+	_, err = parseFrameAuxData(make([]byte, frameAuxDataSize-1))
+	if !errors.Is(err, ErrMessage) {
+		t.Fatalf("expected ErrMessage for truncated aux data, got %v", err)
+	}
+}
@@ -1,8 +1,11 @@
 package slurpeeth
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,6 +13,7 @@ import (
 func NewWorker(
 	port uint16,
 	dialTimeout time.Duration,
+	tcpOptions TCPOptions,
 	segment Segment,
 	errChan chan error,
 	retry,
@@ -22,6 +26,7 @@ func NewWorker(
 		port: port,
 
 		dialTimeout: dialTimeout,
+		tcpOptions:  tcpOptions,
 
 		segment: segment,
 
@@ -29,16 +34,56 @@ func NewWorker(
 
 		interfaceErrChan:      make(chan error),
 		interfaceShutdownChan: make(chan bool),
-		interfaces:            make([]interfaceWorker, len(segment.Interfaces)),
+		interfaces:            make([]*interfaceWorker, len(segment.Interfaces)),
 
 		destinationFanoutChan:   make(chan *Message),
 		destinationErrChan:      make(chan destinationError),
 		destinationShutdownChan: make(chan bool),
-		destinations:            make([]destinationWorker, len(segment.Destinations)),
+		destinations:            make([]destinationWorker, 0, len(segment.Destinations)),
+		destinationGroups:       make([][]int, 0, len(segment.Destinations)),
+
+		destinationGroupAddresses: make([]string, 0, len(segment.Destinations)),
+		destinationGroupNames:     make([]string, 0, len(segment.Destinations)),
+		resolvedDestinations:      map[string]*resolvedDestination{},
+
+		linkStateChan: make(chan bool, 1),
 
 		shutdownChan: make(chan bool),
 	}
 
+	switch segment.Mode {
+	case "", SegmentModeHub:
+	case SegmentModeSwitch:
+		ageTime := segment.MACAgeTime
+		if ageTime <= 0 {
+			ageTime = MACAgeTime
+		}
+
+		s.macTable = newMACTable(ageTime)
+	default:
+		return nil, fmt.Errorf(
+			"%w: unsupported mode %q for tunnel id %d", ErrConfig, segment.Mode, segment.ID,
+		)
+	}
+
+	var egress, ingress *Impairment
+
+	if segment.Impairments != nil {
+		egress = segment.Impairments.Egress
+		ingress = segment.Impairments.Ingress
+	}
+
+	for _, impairment := range []*Impairment{egress, ingress} {
+		if impairment == nil {
+			continue
+		}
+
+		err := impairment.validate()
+		if err != nil {
+			return nil, fmt.Errorf("%w (tunnel id %d)", err, segment.ID)
+		}
+	}
+
 	for idx, segmentInterface := range segment.Interfaces {
 		w, err := newInterfaceWorker(segment.Name, segmentInterface)
 		if err != nil {
@@ -48,18 +93,128 @@ func NewWorker(
 		s.interfaces[idx] = w
 	}
 
-	for idx, destination := range segment.Destinations {
-		s.destinations[idx] = destinationWorker{
-			name:         destination,
-			idx:          idx,
-			sendChan:     make(chan *Message),
-			shutdownChan: make(chan bool),
+	for _, destination := range segment.Destinations {
+		if destination.Streams < 0 {
+			return nil, fmt.Errorf(
+				"%w: destination %q for tunnel id %d has negative stream count",
+				ErrConfig,
+				destination.Address,
+				segment.ID,
+			)
+		}
+
+		if destination.Address == "" && destination.Command == "" {
+			return nil, fmt.Errorf(
+				"%w: destination for tunnel id %d has neither an address nor a command",
+				ErrConfig,
+				segment.ID,
+			)
+		}
+
+		if destination.Command == "" && isLoopbackAddress(destination.Address) {
+			// a loopback destination is just this instance -- frames between our own interfaces
+			// are bridged in process, no need to loop them through the listener
+			log.Printf(
+				"ignoring loopback destination %q for tunnel id %d, local interfaces are bridged"+
+					" directly",
+				destination.Address,
+				segment.ID,
+			)
+
+			continue
+		}
+
+		label := destination.Address
+		if label == "" {
+			label = destination.Command
+		}
+
+		streams := destination.Streams
+		if streams == 0 {
+			streams = 1
+		}
+
+		group := make([]int, 0, streams)
+
+		for stream := 0; stream < streams; stream++ {
+			name := label
+			if streams > 1 {
+				name = fmt.Sprintf("%s/%d", label, stream)
+			}
+
+			idx := len(s.destinations)
+
+			s.destinations = append(s.destinations, destinationWorker{
+				name:         name,
+				address:      destination.Address,
+				command:      destination.Command,
+				idx:          idx,
+				sendChan:     make(chan *Message, DestinationQueueSize),
+				shutdownChan: make(chan bool),
+			})
+
+			group = append(group, idx)
+		}
+
+		s.destinationGroups = append(s.destinationGroups, group)
+		s.destinationGroupAddresses = append(s.destinationGroupAddresses, destination.Address)
+		s.destinationGroupNames = append(s.destinationGroupNames, label)
+	}
+
+	err := validateLinkStatePropagation(&segment)
+	if err != nil {
+		return nil, fmt.Errorf("%w (tunnel id %d)", err, segment.ID)
+	}
+
+	if segment.StormControl != nil {
+		err := segment.StormControl.validate(segment.Mode)
+		if err != nil {
+			return nil, fmt.Errorf("%w (tunnel id %d)", err, segment.ID)
+		}
+
+		s.stormControl = newStormControl(segment.StormControl)
+	}
+
+	if segment.Shaping != nil {
+		err := s.createShapers()
+		if err != nil {
+			return nil, fmt.Errorf("%w (tunnel id %d)", err, segment.ID)
+		}
+	}
+
+	if segment.Capture != nil {
+		err = s.startCapture(*segment.Capture)
+		if err != nil {
+			s.closeShapers()
+
+			return nil, fmt.Errorf("%w (tunnel id %d)", err, segment.ID)
+		}
+	}
+
+	s.egressImpairer = newImpairer(egress)
+	s.ingressImpairer = newImpairer(ingress)
+
+	if s.macTable != nil {
+		// start resolving destination hostnames, they are needed to learn which destination a
+		// remote mac is behind
+		for _, address := range s.destinationGroupAddresses {
+			s.resolveDestination(address)
 		}
 	}
 
 	return s, nil
 }
 
+func isLoopbackAddress(address string) bool {
+	if address == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(address)
+
+	return ip != nil && ip.IsLoopback()
+}
+
 // Worker is an object that works for a given segment -- a p2p connection.
 type Worker struct {
 	retry bool
@@ -68,6 +223,7 @@ type Worker struct {
 	port uint16
 
 	dialTimeout time.Duration
+	tcpOptions  TCPOptions
 
 	segment Segment
 
@@ -77,13 +233,55 @@ type Worker struct {
 
 	interfaceErrChan      chan error
 	interfaceShutdownChan chan bool
-	interfaces            []interfaceWorker
+	interfaces            []*interfaceWorker
+	linkMonitors          []*linkMonitor
 
 	// senders to destinations we represent
 	destinationFanoutChan   chan *Message
 	destinationErrChan      chan destinationError
 	destinationShutdownChan chan bool
 	destinations            []destinationWorker
+	// destinationGroups holds the indexes (in destinations) of the streams for each configured
+	// destination -- every message is sent to exactly one stream of each group.
+	destinationGroups [][]int
+	// destinationGroupAddresses holds the configured address of each destination group.
+	destinationGroupAddresses []string
+	// destinationGroupNames holds the name (address, or command) of each destination group.
+	destinationGroupNames []string
+	// destinationShapers holds the shaper of each destination group, nil unless the segment is
+	// shaped -- all streams of a destination share one link.
+	destinationShapers       []*shaper
+	resolvedDestinations     map[string]*resolvedDestination
+	resolvedDestinationsLock sync.Mutex
+
+	// macTable is the segment's mac table, nil unless the segment is in switch mode.
+	macTable *macTable
+
+	// egressImpairer and ingressImpairer impair frames from local interfaces and from remotes
+	// respectively, they always exist (with no impairments by default) so impairments can be
+	// set at runtime.
+	egressImpairer  *impairer
+	ingressImpairer *impairer
+
+	// stormControl polices flooded frames, nil unless the segment has storm control.
+	stormControl *stormControl
+
+	// paused is set while the segment is paused -- frames are still read but not forwarded,
+	// pauseReason says why (for logging and the api).
+	paused      atomic.Bool
+	pauseReason string
+	pauseLock   sync.Mutex
+
+	// linkStateChan feeds changes of the segment's link state to the goroutine sending them to
+	// peers, linkStateUp is the last state (if linkStateKnown), see propagate-link-state.
+	linkStateChan  chan bool
+	linkStateDone  chan struct{}
+	linkStateKnown bool
+	linkStateUp    bool
+	linkStateLock  sync.Mutex
+
+	// capture is the segment's packet capture, nil when not capturing.
+	capture atomic.Pointer[capture]
 
 	shutdownInProgress bool
 	shutdownChan       chan bool
@@ -94,6 +292,15 @@ func (w *Worker) Bind() error {
 	log.Printf("binding for worker for tunnel id %d", w.segment.ID)
 
 	for idx := range w.interfaces {
+		if w.interfaces[idx].waiting {
+			log.Printf(
+				"interface %q for worker for tunnel id %d is missing, will bind when it appears",
+				w.interfaces[idx].name, w.segment.ID,
+			)
+
+			continue
+		}
+
 		log.Printf(
 			"binding to interface %q for worker for tunnel id %d",
 			w.interfaces[idx].name, w.segment.ID,
@@ -101,6 +308,13 @@ func (w *Worker) Bind() error {
 
 		err := w.bindInterface(idx)
 		if err != nil {
+			if w.interfaces[idx].create == "" && !w.interfaces[idx].exists() {
+				// vanished between lookup and bind, just wait for it to come back
+				w.interfaces[idx].waiting = true
+
+				continue
+			}
+
 			return err
 		}
 	}
@@ -177,15 +391,44 @@ func (w *Worker) destinationFanout() {
 				w.destinations[idx].shutdownChan <- true
 			}
 		case msg := <-w.destinationFanoutChan:
-			for idx := range w.destinations {
-				// future: should this or this for loop be in a goroutine? so we dont block sending?
-				// and/or should the channels be buffered for some amount?
-				w.destinations[idx].sendChan <- msg
+			for groupIdx := range w.destinationGroups {
+				w.sendToDestinationGroup(groupIdx, msg)
 			}
 		}
 	}
 }
 
+// sendToDestinationGroup sends msg to a single destination group, via the group's shaper if the
+// segment is shaped.
+func (w *Worker) sendToDestinationGroup(groupIdx int, msg *Message) {
+	if w.destinationShapers != nil {
+		w.destinationShapers[groupIdx].enqueue(msg)
+
+		return
+	}
+
+	w.sendToDestinationStream(groupIdx, msg)
+}
+
+// sendToDestinationStream sends msg to the stream of destination group groupIdx its flow hashes
+// to. This never blocks -- if the stream's queue is full (it is slow, or not connected at all) the
+// message is dropped rather than holding up the rest of the segment.
+func (w *Worker) sendToDestinationStream(groupIdx int, msg *Message) {
+	group := w.destinationGroups[groupIdx]
+
+	idx := group[0]
+
+	if len(group) > 1 {
+		idx = group[flowHash(msg.Body)%uint32(len(group))]
+	}
+
+	select {
+	case w.destinations[idx].sendChan <- msg:
+	default:
+		w.destinations[idx].dropped.Add(1)
+	}
+}
+
 // Run runs the worker forever. The worker should manage the connection, restarting things if
 // needed. Any errors should be returned on the error channel the worker was created with.
 func (w *Worker) Run() {
@@ -203,6 +446,13 @@ func (w *Worker) Shutdown(wg *sync.WaitGroup) {
 
 	// send the shutdown signal to stop things
 	w.shutdownInProgress = true
+	w.stopLinkMonitors()
+	w.stopLinkStatePropagation()
+	w.egressImpairer.close()
+	w.ingressImpairer.close()
+	w.closeShapers()
+	w.releaseLinks()
+	w.stopCapture()
 	w.shutdownChan <- true
 
 	// wait until things have closed and the conn/listener are nil'd
@@ -228,19 +478,19 @@ func (w *Worker) Shutdown(wg *sync.WaitGroup) {
 			continue
 		}
 
-		var interfaceFdsNotZero bool
+		var interfacesNotClosed bool
 
 		for idx := range w.interfaces {
-			if w.interfaces[idx].fd != 0 {
-				interfaceFdsNotZero = true
+			if w.interfaces[idx].currentIO() != nil {
+				interfacesNotClosed = true
 
 				break
 			}
 		}
 
-		if interfaceFdsNotZero {
+		if interfacesNotClosed {
 			log.Printf(
-				"interface fds for worker for tunnel id %d are not closed yet",
+				"interfaces for worker for tunnel id %d are not closed yet",
 				w.segment.ID,
 			)
 
@@ -256,3 +506,57 @@ func (w *Worker) Shutdown(wg *sync.WaitGroup) {
 
 	wg.Done()
 }
+
+// pause stops the worker forwarding frames until it is resumed, returns false if the worker was
+// already paused.
+func (w *Worker) pause(reason string) bool {
+	w.pauseLock.Lock()
+	defer w.pauseLock.Unlock()
+
+	if w.paused.Load() {
+		return false
+	}
+
+	w.pauseReason = reason
+	w.paused.Store(true)
+
+	return true
+}
+
+// resume resumes forwarding of a paused worker, returns false if the worker was not paused.
+func (w *Worker) resume() bool {
+	w.pauseLock.Lock()
+	defer w.pauseLock.Unlock()
+
+	if !w.paused.Load() {
+		return false
+	}
+
+	w.pauseReason = ""
+	w.paused.Store(false)
+
+	return true
+}
+
+// resumeIf resumes the worker only if it is (still) paused for reason -- so a delayed resume does
+// not undo a later pause for some other reason.
+func (w *Worker) resumeIf(reason string) bool {
+	w.pauseLock.Lock()
+	defer w.pauseLock.Unlock()
+
+	if !w.paused.Load() || w.pauseReason != reason {
+		return false
+	}
+
+	w.pauseReason = ""
+	w.paused.Store(false)
+
+	return true
+}
+
+func (w *Worker) pauseState() (paused bool, reason string) {
+	w.pauseLock.Lock()
+	defer w.pauseLock.Unlock()
+
+	return w.paused.Load(), w.pauseReason
+}
@@ -4,16 +4,27 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 type destinationWorker struct {
+	// name is the address of the destination, suffixed with the stream number when the
+	// destination has multiple streams -- it is only used for logging.
 	name           string
+	address        string
+	command        string
 	idx            int
 	dialRetryCount int
 	sendChan       chan *Message
 	shutdownChan   chan bool
 	conn           net.Conn
+	// multipath is the mptcp state of the current connection (see TCPOptions.multipathStatus),
+	// nil until the destination was dialed.
+	multipath atomic.Pointer[string]
+	// dropped counts messages dropped because the destination's queue was full.
+	dropped atomic.Uint64
 }
 
 func (w *Worker) restartDestination(idx int) {
@@ -29,11 +40,17 @@ func (w *Worker) restartDestination(idx int) {
 
 func (w *Worker) shutdownDestination(idx int) {
 	log.Printf(
-		"destination %q for tunnel id %d received shutdown request",
+		"destination %q for tunnel id %d received shutdown request, dropped %d messages",
 		w.destinations[idx].name,
 		w.segment.ID,
+		w.destinations[idx].dropped.Load(),
 	)
 
+	if w.destinations[idx].conn == nil {
+		// still (re)dialing, nothing to close
+		return
+	}
+
 	err := w.destinations[idx].conn.Close()
 	if err != nil {
 		log.Printf(
@@ -70,7 +87,7 @@ func (w *Worker) runDestination(idx int) {
 		w.destinations[idx].conn = nil
 	}
 
-	c, err := w.runDestinationDialRetry(w.destinations[idx].name)
+	c, err := w.runDestinationDialRetry(idx)
 	if err != nil {
 		w.destinations[idx].dialRetryCount++
 
@@ -106,24 +123,49 @@ func (w *Worker) runDestination(idx int) {
 	w.runDestinationHandler(idx)
 }
 
-func (w *Worker) runDestinationDialRetry(destination string) (net.Conn, error) {
-	addr := fmt.Sprintf("%s:%d", destination, w.port)
+func (w *Worker) runDestinationDialRetry(idx int) (net.Conn, error) {
+	if w.destinations[idx].command != "" {
+		log.Printf(
+			"starting command %q for destination %q for tunnel id %d",
+			w.destinations[idx].command,
+			w.destinations[idx].name,
+			w.segment.ID,
+		)
+
+		return dialCommand(w.destinations[idx].command, w.destinations[idx].address, w.port)
+	}
+
+	addr := net.JoinHostPort(w.destinations[idx].address, strconv.Itoa(int(w.port)))
 
 	log.Printf("dial destination %q for tunnel id %d", addr, w.segment.ID)
 
 	startTime := time.Now()
 	deadline := startTime.Add(w.dialTimeout)
 
+	dialer := w.tcpOptions.dialer()
+
 	var retries int
 
 	for {
-		c, err := net.Dial(TCP, addr)
+		c, err := dialer.Dial(TCP, addr)
 		if err == nil {
+			err = w.tcpOptions.apply(c)
+			if err != nil {
+				_ = c.Close()
+
+				return nil, err
+			}
+
+			multipath := w.tcpOptions.multipathStatus(c)
+
+			w.destinations[idx].multipath.Store(&multipath)
+
 			log.Printf(
-				"dial destination %q succeeded on attempt %d for tunnel id %d",
+				"dial destination %q succeeded on attempt %d for tunnel id %d, multipath tcp %s",
 				addr,
 				retries,
 				w.segment.ID,
+				multipath,
 			)
 
 			return c, nil
@@ -196,9 +238,13 @@ func (w *Worker) runDestinationHandler(idx int) {
 					err:  err,
 				}
 
-				continue
+				// one error per connection -- the restart (if any) runs a new handler, and
+				// queued messages would only fail (and trigger restarts) all over again
+				return
 			}
 
+			w.captureDestination(idx, msg)
+
 			if uint16(n) != msg.Header.TotalSize {
 				log.Printf(
 					"wrote %d bytes to destination %q for tunnel id %d, but expected to write %d",
@@ -2,11 +2,15 @@ package slurpeeth
 
 import (
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"sync"
+	"sync/atomic"
 	"syscall"
-	"unsafe"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -15,15 +19,68 @@ type interfaceWorker struct {
 	// sender is a 10 character string that is a hash of the segment information -- meant to
 	// uniquely represent this worker in a message header (so we don't send messages from this
 	// worker back to itself).
-	sender       string
-	name         string
-	details      *syscall.SockaddrLinklayer
-	fd           int
+	sender string
+	name   string
+	create string
+	veth   *VethOptions
+	// namespace is the network namespace the interface lives in, empty for slurpeeth's own
+	namespace string
+	backend   string
+	promisc   bool
+	allMulti  bool
+	// filter is the compiled bpf filter for the interface's socket, nil for no filter
+	filter []unix.SockFilter
+	vlan   *VlanOptions
+	// ifindex is the index of the (existing) interface to bind to, unused when slurpeeth creates
+	// the interface itself
+	ifindex      int
+	io           interfaceIO
 	sendChan     chan *Message
 	shutdownChan chan bool
+
+	// waiting is true when the interface does not exist (yet, or anymore) -- the worker binds to
+	// the interface when it shows up. mu guards waiting, ifindex and io once the worker is
+	// running.
+	waiting bool
+	mu      sync.Mutex
+
+	// linkForced is the way ("carrier" or "admin") the interface's link was forced down by
+	// setAdminDown, empty if it was not. Guarded by mu.
+	linkForced string
+	// linkForcedRemote is true if the link was forced down because the segment's peer was down
+	// (see propagate-link-state) rather than via setAdminDown. Guarded by mu.
+	linkForcedRemote bool
+	// restoredAt is when the link was last restored after being forced down. Guarded by mu.
+	restoredAt time.Time
+	// operUp is the last seen operational state of the interface, only tracked for segments
+	// propagating link state. Guarded by mu.
+	operUp bool
+
+	// shaper paces frames to the interface, nil unless the segment is shaped.
+	shaper *shaper
+
+	// suppressedOutgoing counts frames read from the interface that were transmitted out of it
+	// (by us or the host) and so were not forwarded, see errOutgoingFrame.
+	suppressedOutgoing atomic.Uint64
+}
+
+func (i *interfaceWorker) currentIO() interfaceIO {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.io
 }
 
-func newInterfaceWorker(segmentName, interfaceName string) (interfaceWorker, error) {
+func (i *interfaceWorker) isWaiting() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.waiting
+}
+
+func newInterfaceWorker(segmentName string, segmentInterface Interface) (*interfaceWorker, error) {
+	interfaceName := segmentInterface.Name
+
 	segmentHash := sha256.New()
 	segmentHash.Write([]byte(segmentName))
 	segmentHash.Write([]byte(interfaceName))
@@ -37,54 +94,212 @@ func newInterfaceWorker(segmentName, interfaceName string) (interfaceWorker, err
 		sender,
 	)
 
-	namedInterface, err := interfaceByNameOrAlias(interfaceName)
+	w := &interfaceWorker{
+		sender:       sender,
+		name:         interfaceName,
+		create:       segmentInterface.Create,
+		veth:         segmentInterface.Veth,
+		vlan:         segmentInterface.Vlan,
+		namespace:    segmentInterface.Namespace,
+		backend:      segmentInterface.Backend,
+		promisc:      segmentInterface.Promisc,
+		allMulti:     segmentInterface.AllMulti,
+		sendChan:     make(chan *Message),
+		shutdownChan: make(chan bool),
+	}
+
+	switch segmentInterface.Backend {
+	case "", InterfaceBackendPacket, InterfaceBackendRing, InterfaceBackendXDP:
+	default:
+		return nil, fmt.Errorf(
+			"%w: unsupported backend %q for interface %q",
+			ErrConfig,
+			segmentInterface.Backend,
+			interfaceName,
+		)
+	}
+
+	filter, err := interfaceFilter(segmentInterface)
 	if err != nil {
-		return interfaceWorker{}, err
+		return nil, err
 	}
 
-	interfaceDetails := &syscall.SockaddrLinklayer{
-		Ifindex: namedInterface.Index,
+	if filter != nil {
+		if segmentInterface.Create == InterfaceCreateTap ||
+			segmentInterface.Backend == InterfaceBackendXDP {
+			return nil, fmt.Errorf(
+				"%w: filters/vlans are not supported for tap devices or the xdp backend,"+
+					" interface %q",
+				ErrConfig,
+				interfaceName,
+			)
+		}
+
+		w.filter, err = compileFilter(filter)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return interfaceWorker{
-		sender:       sender,
-		name:         interfaceName,
-		details:      interfaceDetails,
-		fd:           0,
-		sendChan:     make(chan *Message),
-		shutdownChan: make(chan bool),
+	switch segmentInterface.Create {
+	case "":
+		err := w.lookup()
+		if errors.Is(err, errInterfaceNotFound) {
+			log.Printf(
+				"interface %q for segment %q does not exist (yet?), waiting for it to appear",
+				interfaceName,
+				segmentName,
+			)
+
+			w.waiting = true
+		} else if err != nil {
+			return nil, err
+		}
+	case InterfaceCreateTap:
+	case InterfaceCreateVeth:
+		if segmentInterface.Veth == nil || segmentInterface.Veth.Peer == "" {
+			return nil, fmt.Errorf(
+				"%w: interface %q is a veth but has no peer name", ErrConfig, interfaceName,
+			)
+		}
+	default:
+		return nil, fmt.Errorf(
+			"%w: unsupported create value %q for interface %q",
+			ErrConfig,
+			segmentInterface.Create,
+			interfaceName,
+		)
+	}
+
+	return w, nil
+}
+
+// interfaceFilter returns the filter for the interface -- the configured filter, restricted to the
+// interface's vlan if it has one (so each segment on a trunk only reads its own vlan).
+func interfaceFilter(segmentInterface Interface) (*Filter, error) {
+	if segmentInterface.Vlan == nil {
+		return segmentInterface.Filter, nil
+	}
+
+	if segmentInterface.Vlan.ID < 1 || segmentInterface.Vlan.ID > vlanIDMax {
+		return nil, fmt.Errorf(
+			"%w: invalid vlan id %d for interface %q",
+			ErrConfig,
+			segmentInterface.Vlan.ID,
+			segmentInterface.Name,
+		)
+	}
+
+	vlanExpression := fmt.Sprintf("vlan %d", segmentInterface.Vlan.ID)
+
+	if segmentInterface.Filter == nil {
+		return &Filter{Expression: vlanExpression}, nil
+	}
+
+	if len(segmentInterface.Filter.Instructions) > 0 {
+		return nil, fmt.Errorf(
+			"%w: raw filter instructions can not be combined with a vlan, interface %q",
+			ErrConfig,
+			segmentInterface.Name,
+		)
+	}
+
+	return &Filter{
+		Expression: fmt.Sprintf("%s and (%s)", vlanExpression, segmentInterface.Filter.Expression),
 	}, nil
 }
 
+// lookup finds the (existing) interface in its namespace and stores its index.
+func (i *interfaceWorker) lookup() error {
+	return runInNetns(i.namespace, func() error {
+		namedInterface, err := interfaceByNameOrAlias(i.name)
+		if err != nil {
+			return err
+		}
+
+		i.mu.Lock()
+		i.ifindex = namedInterface.Index
+		i.mu.Unlock()
+
+		return nil
+	})
+}
+
+// exists returns true if the interface index we bound to still exists in the interface's
+// namespace.
+func (i *interfaceWorker) exists() bool {
+	i.mu.Lock()
+	ifindex := i.ifindex
+	i.mu.Unlock()
+
+	err := runInNetns(i.namespace, func() error {
+		_, err := getLink(ifindex)
+
+		return err
+	})
+
+	return err == nil
+}
+
 func (w *Worker) shutdownInterface(idx int) {
 	log.Printf(
-		"interface %q for tunnel id %d received shutdown",
+		"interface %q for tunnel id %d received shutdown, suppressed %d outgoing frames",
 		w.interfaces[idx].name,
 		w.segment.ID,
+		w.interfaces[idx].suppressedOutgoing.Load(),
 	)
 
-	err := syscall.Close(w.interfaces[idx].fd)
+	w.closeInterface(idx)
+}
+
+func (w *Worker) closeInterface(idx int) {
+	w.interfaces[idx].mu.Lock()
+	defer w.interfaces[idx].mu.Unlock()
+
+	if w.interfaces[idx].io == nil {
+		return
+	}
+
+	err := w.interfaces[idx].io.close()
 	if err != nil {
 		log.Printf(
-			"ignoring error closing fd for interface %q for tunnel id %d, err: %s",
+			"ignoring error closing interface %q for tunnel id %d, err: %s",
 			w.interfaces[idx].name,
 			w.segment.ID,
 			err,
 		)
 	}
 
-	w.interfaces[idx].fd = 0
+	w.interfaces[idx].io = nil
 }
 
-func (w *Worker) runInterfaces() {
+func (w *Worker) releaseInterfaces() {
+	w.shutdownInProgress = true
+
+	w.stopLinkMonitors()
+	w.stopLinkStatePropagation()
+	w.releaseLinks()
+	w.stopCapture()
+
 	for idx := range w.interfaces {
-		w.runInterface(idx)
+		w.shutdownInterface(idx)
 	}
 }
 
-func (w *Worker) runInterface(idx int) {
-	go w.runInterfaceRead(idx)
-	go w.runInterfaceWrite(idx)
+func (w *Worker) runInterfaces() {
+	for idx := range w.interfaces {
+		// writers run for the life of the worker -- they drop frames while the interface is
+		// missing; readers only run while the interface is bound
+		go w.runInterfaceWrite(idx)
+
+		handle := w.interfaces[idx].currentIO()
+		if handle != nil {
+			go w.runInterfaceRead(idx, handle)
+		}
+	}
+
+	w.startLinkMonitors()
+	w.startLinkStatePropagation()
 }
 
 func (w *Worker) bindInterface(idx int) error {
@@ -93,47 +308,37 @@ func (w *Worker) bindInterface(idx int) error {
 		w.interfaces[idx].name, w.segment.ID, w.interfaces[idx].sender,
 	)
 
-	fd, err := syscall.Socket(
-		syscall.AF_PACKET,
-		syscall.SOCK_RAW,
-		EthPAll,
-	)
-	if err != nil {
-		closeErr := syscall.Close(fd)
-		if closeErr != nil {
-			log.Printf(
-				"encountered initial error %q, and subsequent error %q attempting to"+
-					" close file descriptor",
-				err, closeErr,
+	var handle interfaceIO
+
+	// sockets/devices are created in the interface's namespace and stay there after we return
+	err := runInNetns(w.interfaces[idx].namespace, func() error {
+		var err error
+
+		switch w.interfaces[idx].create {
+		case InterfaceCreateTap:
+			handle, err = newTapDevice(w.interfaces[idx].name)
+		case InterfaceCreateVeth:
+			handle, err = newVethPair(
+				w.interfaces[idx].name,
+				w.interfaces[idx].namespace,
+				w.interfaces[idx].veth,
+				w.interfaces[idx].filter,
 			)
+		default:
+			handle, err = w.newInterfaceBackend(idx)
 		}
 
-		return err
-	}
+		if err != nil {
+			return err
+		}
 
-	err = syscall.Bind(fd, w.interfaces[idx].details)
-	if err != nil {
-		closeErr := syscall.Close(fd)
-		if closeErr != nil {
-			log.Printf(
-				"encountered error %q binding to interface %s, and subsequent error %q"+
-					" attempting to close file descriptor",
-				err, w.interfaces[idx].name, closeErr,
-			)
+		if w.interfaces[idx].promisc || w.interfaces[idx].allMulti {
+			handle, err = w.addMemberships(idx, handle)
 		}
 
 		return err
-	}
-
-	// tell the kernel we want the packet aux data (that has vlan info)
-	err = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, PacketAuxData, 1)
+	})
 	if err != nil {
-		log.Printf(
-			"encountered error setting PACKET_AUX_DATA request for socket for"+
-				" interface %s, err: %s",
-			w.interfaces[idx].name, err,
-		)
-
 		return err
 	}
 
@@ -143,12 +348,91 @@ func (w *Worker) bindInterface(idx int) error {
 		w.segment.ID,
 	)
 
-	w.interfaces[idx].fd = fd
+	w.interfaces[idx].mu.Lock()
+	w.interfaces[idx].io = handle
+	w.interfaces[idx].waiting = false
+	w.interfaces[idx].mu.Unlock()
 
 	return nil
 }
 
-func (w *Worker) runInterfaceRead(idx int) {
+// addMemberships wraps handle so the interface's promisc/allmulti memberships are held for as long
+// as handle is open. It must be called from within the interface's namespace.
+func (w *Worker) addMemberships(idx int, handle interfaceIO) (interfaceIO, error) {
+	ifindex := w.interfaces[idx].ifindex
+
+	if w.interfaces[idx].create != "" {
+		// we created it, so we never looked it up
+		createdInterface, err := net.InterfaceByName(w.interfaces[idx].name)
+		if err != nil {
+			_ = handle.close()
+
+			return nil, fmt.Errorf(
+				"%w: failed finding interface %q, error: %w", ErrBind, w.interfaces[idx].name, err,
+			)
+		}
+
+		ifindex = createdInterface.Index
+	}
+
+	membership, err := newPacketMembership(
+		w.interfaces[idx].name,
+		ifindex,
+		w.interfaces[idx].promisc,
+		w.interfaces[idx].allMulti,
+	)
+	if err != nil {
+		_ = handle.close()
+
+		return nil, err
+	}
+
+	return &membershipIO{interfaceIO: handle, membership: membership}, nil
+}
+
+// newInterfaceBackend returns the interfaceIO for binding to an existing interface per the
+// interface's configured backend -- falling back to a plain packet socket if the requested backend
+// is not available.
+func (w *Worker) newInterfaceBackend(idx int) (interfaceIO, error) {
+	var handle interfaceIO
+
+	var err error
+
+	switch w.interfaces[idx].backend {
+	case InterfaceBackendRing:
+		handle, err = newPacketRing(
+			w.interfaces[idx].name, w.interfaces[idx].ifindex, w.interfaces[idx].filter,
+		)
+	case InterfaceBackendXDP:
+		handle, err = newXDPInterface(
+			w.interfaces[idx].name,
+			w.interfaces[idx].namespace,
+			w.interfaces[idx].ifindex,
+		)
+	default:
+		return newPacketSocket(
+			w.interfaces[idx].name, w.interfaces[idx].ifindex, w.interfaces[idx].filter,
+		)
+	}
+
+	if err == nil {
+		return handle, nil
+	}
+
+	log.Printf(
+		"failed setting up %s backend for interface %q for tunnel id %d, falling back to"+
+			" packet backend, err: %s",
+		w.interfaces[idx].backend, w.interfaces[idx].name, w.segment.ID, err,
+	)
+
+	return newPacketSocket(
+		w.interfaces[idx].name, w.interfaces[idx].ifindex, w.interfaces[idx].filter,
+	)
+}
+
+// runInterfaceRead reads frames from handle (the interface's current binding) until the worker is
+// shutdown or the binding is released.
+func (w *Worker) runInterfaceRead(idx int, handle interfaceIO) {
 	for {
 		select {
 		case <-w.interfaces[idx].shutdownChan:
@@ -168,33 +452,38 @@ func (w *Worker) runInterfaceRead(idx int) {
 				return
 			}
 
-			data := make([]byte, ReadSize)
-			auxData := make([]byte, syscall.CmsgLen(AuxReadSize))
+			data, err := handle.readFrame()
+			if errors.Is(err, errOutgoingFrame) {
+				w.interfaces[idx].suppressedOutgoing.Add(1)
+
+				continue
+			}
 
-			readN, auxReadN, _, _, err := syscall.Recvmsg(w.interfaces[idx].fd, data, auxData, 0)
 			if err != nil {
-				log.Printf(
-					"encountered error receiving from interface %q for tunnel id %d, err: %s",
-					w.interfaces[idx].name, w.segment.ID, err,
-				)
+				if w.shutdownInProgress || w.interfaces[idx].currentIO() != handle {
+					// the interface was closed out from under us, thats expected, just be done
+					return
+				}
 
-				w.interfaceErrChan <- err
+				if !w.interfaces[idx].exists() {
+					w.interfaceGone(idx, handle)
 
-				return
-			}
+					return
+				}
 
-			data = data[:readN]
+				if errors.Is(err, syscall.ENETDOWN) {
+					// the interface went down but still exists, packet sockets report this once
+					// and then carry on, so we do too
+					log.Printf(
+						"interface %q for tunnel id %d went down, continuing to read",
+						w.interfaces[idx].name, w.segment.ID,
+					)
+
+					continue
+				}
 
-			// we have to get the "aux" data from the kernel for our socket -- these socket control
-			// messages hold vlan tag info we may have to re-add back to the data we slurped up.
-			// very useful so post about this stuff since this is all a bit of dark magic!
-			// https://stackoverflow.com/questions/56653023/ \
-			//	reading-vlan-field-of-a-raw-ethernet-packet-in-python
-			controlMsgs, err := syscall.ParseSocketControlMessage(auxData[:auxReadN])
-			if err != nil {
 				log.Printf(
-					"encountered error procesing socket control message(s) from interface %q"+
-						" for tunnel id %d, err: %s",
+					"encountered error receiving from interface %q for tunnel id %d, err: %s",
 					w.interfaces[idx].name, w.segment.ID, err,
 				)
 
@@ -203,39 +492,48 @@ func (w *Worker) runInterfaceRead(idx int) {
 				return
 			}
 
-			for _, controlMsg := range controlMsgs {
-				if controlMsg.Header.Level == syscall.SOL_PACKET &&
-					controlMsg.Header.Type == PacketAuxData {
-					parsedAuxData := (*frameAuxData)(
-						unsafe.Pointer(&controlMsg.Data[0]), //nolint:gosec
-					)
-
-					if parsedAuxData.vlanTCI != 0 ||
-						parsedAuxData.status&unix.TP_STATUS_VLAN_VALID == 1 {
-						var taggedData []byte
-
-						vlanTag := make([]byte, VlanTagSize)
-
-						// pack our tag stuff into the bytes
-						binary.BigEndian.PutUint16(vlanTag[0:], parsedAuxData.vlanTPID)
-						binary.BigEndian.PutUint16(vlanTag[2:], parsedAuxData.vlanTCI)
-
-						taggedData = append(taggedData, data[:12]...)
-						taggedData = append(taggedData, vlanTag...)
-						taggedData = append(taggedData, data[12:]...)
+			w.captureInterface(idx, captureInbound, data)
 
-						data = taggedData
-					}
+			if w.interfaces[idx].vlan != nil && w.interfaces[idx].vlan.Pop {
+				id, ok := outerVlanID(data)
+				if ok && id == w.interfaces[idx].vlan.ID {
+					data = popVlanTag(data)
 				}
 			}
 
 			msg := NewMessageFromBody(w.segment.ID, w.interfaces[idx].sender, data)
 
-			w.destinationFanoutChan <- &msg
+			w.egressImpairer.process(&msg, func(m *Message) {
+				w.forwardFromInterface(idx, m)
+			})
 		}
 	}
 }
 
+// relayToInterfaces sends msg to all of the worker's interfaces, except the interface the message
+// originally came from (if it came from this worker).
+func (w *Worker) relayToInterfaces(msg *Message) {
+	for idx := range w.interfaces {
+		if msg.Header.Sender == w.interfaces[idx].sender {
+			// message came from this interface, dont send it back to them
+			continue
+		}
+
+		w.sendToInterface(idx, msg)
+	}
+}
+
+// sendToInterface sends msg to interface idx, via the interface's shaper if it has one.
+func (w *Worker) sendToInterface(idx int, msg *Message) {
+	if w.interfaces[idx].shaper != nil {
+		w.interfaces[idx].shaper.enqueue(msg)
+
+		return
+	}
+
+	w.interfaces[idx].sendChan <- msg
+}
+
 func (w *Worker) runInterfaceWrite(idx int) {
 	for {
 		select {
@@ -250,14 +548,53 @@ func (w *Worker) runInterfaceWrite(idx int) {
 				return
 			}
 
-			err := syscall.Sendto(w.interfaces[idx].fd, msg.Body, 0, w.interfaces[idx].details)
+			handle := w.interfaces[idx].currentIO()
+			if handle == nil {
+				if w.debug {
+					log.Printf(
+						"dropping message for missing interface %q for tunnel id %d",
+						w.interfaces[idx].name, w.segment.ID,
+					)
+				}
+
+				continue
+			}
+
+			frame := msg.Body
+
+			if w.interfaces[idx].vlan != nil && w.interfaces[idx].vlan.Push {
+				frame = pushVlanTag(frame, w.interfaces[idx].vlan.ID)
+			}
+
+			err := handle.writeFrame(frame)
 			if err != nil {
+				if w.shutdownInProgress {
+					return
+				}
+
+				if w.interfaces[idx].currentIO() != handle ||
+					errors.Is(err, syscall.ENETDOWN) ||
+					errors.Is(err, ErrMessage) ||
+					!w.interfaces[idx].exists() {
+					// interface is down or went away, or the frame could not be written (too
+					// large, malformed), thats just a dropped frame, if the interface went away
+					// the reader (or link monitor) takes care of waiting for it to return
+					log.Printf(
+						"dropped message for interface %q for tunnel id %d, err: %s",
+						w.interfaces[idx].name, w.segment.ID, err,
+					)
+
+					continue
+				}
+
 				log.Printf(
 					"encountered error writing message to interface %q for tunnel id %d, err: %s",
 					w.interfaces[idx].name, w.segment.ID, err,
 				)
 
 				w.interfaceErrChan <- err
+			} else {
+				w.captureInterface(idx, captureOutbound, frame)
 			}
 
 			if w.debug {
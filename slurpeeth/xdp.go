@@ -0,0 +1,535 @@
+package slurpeeth
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// xdpInterface is an interfaceIO backed by AF_XDP sockets -- one per rx queue of the interface,
+// each with its own umem. A tiny xdp program redirects every frame arriving on the interface to the
+// socket for the queue it arrived on, so frames on an xdp interface are *not* seen by the host
+// stack. Note that vlan tags stripped by hardware offload are not visible to xdp, so trunk ports
+// should have rx vlan offload disabled (or use another backend).
+type xdpInterface struct {
+	name      string
+	namespace string
+	ifindex   int
+
+	mapFD       int
+	progFD      int
+	attachFlags uint32
+
+	sockets []*xdpSocket
+	pollFds []unix.PollFd
+
+	rxMu    sync.Mutex
+	txMu    sync.Mutex
+	pending []Bytes
+
+	closing atomic.Bool
+}
+
+// newXDPInterface sets up AF_XDP sockets for the interface. Like the other interfaceIO
+// constructors it must be called from within namespace (if namespace is not empty), namespace is
+// only stored so the xdp program can be detached from the right namespace later.
+func newXDPInterface(name, namespace string, ifindex int) (*xdpInterface, error) {
+	queues := 1
+
+	link, err := getLink(ifindex)
+	if err == nil && len(link.attrs[unix.IFLA_NUM_RX_QUEUES]) == 4 {
+		queues = int(binary.NativeEndian.Uint32(link.attrs[unix.IFLA_NUM_RX_QUEUES]))
+	}
+
+	x := &xdpInterface{
+		name:      name,
+		namespace: namespace,
+		ifindex:   ifindex,
+		mapFD:     -1,
+		progFD:    -1,
+	}
+
+	err = x.setup(queues)
+	if err != nil {
+		x.release()
+
+		return nil, fmt.Errorf(
+			"%w: failed setting up af_xdp for interface %q, error: %w", ErrBind, name, err,
+		)
+	}
+
+	return x, nil
+}
+
+func (x *xdpInterface) setup(queues int) error {
+	var err error
+
+	x.mapFD, err = newXSKMap(queues)
+	if err != nil {
+		return err
+	}
+
+	x.progFD, err = loadXSKRedirectProgram(x.mapFD)
+	if err != nil {
+		return err
+	}
+
+	for queue := 0; queue < queues; queue++ {
+		var s *xdpSocket
+
+		s, err = newXDPSocket(x.ifindex, queue)
+		if err != nil {
+			if queue == 0 {
+				return err
+			}
+
+			// the kernel reports the maximum number of queues, not necessarily how many are in
+			// use, so just stop at the first one we cant bind to
+			log.Printf(
+				"af_xdp for interface %q stopping at %d queue(s), err: %s", x.name, queue, err,
+			)
+
+			break
+		}
+
+		x.sockets = append(x.sockets, s)
+		x.pollFds = append(x.pollFds, unix.PollFd{Fd: int32(s.fd), Events: unix.POLLIN})
+
+		err = updateXSKMap(x.mapFD, queue, s.fd)
+		if err != nil {
+			return err
+		}
+	}
+
+	// prefer native (driver) mode, fall back to generic (skb) mode if the driver has no support
+	for _, mode := range []uint32{unix.XDP_FLAGS_DRV_MODE, unix.XDP_FLAGS_SKB_MODE} {
+		flags := mode | unix.XDP_FLAGS_UPDATE_IF_NOEXIST
+
+		err = setLinkXDP(x.ifindex, x.progFD, flags)
+		if err == nil {
+			x.attachFlags = flags
+
+			log.Printf(
+				"attached af_xdp program to interface %q with flags %#x and %d socket(s)",
+				x.name, flags, len(x.sockets),
+			)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: failed attaching xdp program, error: %w", ErrBind, err)
+}
+
+func (x *xdpInterface) readFrame() (Bytes, error) {
+	x.rxMu.Lock()
+	defer x.rxMu.Unlock()
+
+	for len(x.pending) == 0 {
+		if x.closing.Load() {
+			return nil, fmt.Errorf("%w: af_xdp interface %q", os.ErrClosed, x.name)
+		}
+
+		for _, s := range x.sockets {
+			x.pending = s.receive(x.pending)
+		}
+
+		if len(x.pending) > 0 {
+			break
+		}
+
+		// the poll timeout is so that we periodically check if we've been closed
+		_, err := unix.Poll(x.pollFds, RingPollTimeoutMs)
+		if err != nil && !errors.Is(err, unix.EINTR) {
+			return nil, err
+		}
+	}
+
+	frame := x.pending[0]
+	x.pending = x.pending[1:]
+
+	return frame, nil
+}
+
+func (x *xdpInterface) writeFrame(b Bytes) error {
+	x.txMu.Lock()
+	defer x.txMu.Unlock()
+
+	// writers hold on to the interface io, so this can race with close -- which releases the
+	// sockets
+	if x.closing.Load() || len(x.sockets) == 0 {
+		return fmt.Errorf("%w: af_xdp interface %q", os.ErrClosed, x.name)
+	}
+
+	if len(b) > XDPFrameSize {
+		return fmt.Errorf(
+			"%w: frame of %d bytes too large for af_xdp interface %q", ErrMessage, len(b), x.name,
+		)
+	}
+
+	// frames are always sent from the first queue
+	return x.sockets[0].transmit(b, &x.closing)
+}
+
+func (x *xdpInterface) close() error {
+	x.closing.Store(true)
+
+	x.rxMu.Lock()
+	x.txMu.Lock()
+
+	defer x.rxMu.Unlock()
+	defer x.txMu.Unlock()
+
+	var err error
+
+	if x.attachFlags != 0 {
+		err = runInNetns(x.namespace, func() error {
+			return setLinkXDP(x.ifindex, -1, x.attachFlags&^unix.XDP_FLAGS_UPDATE_IF_NOEXIST)
+		})
+		if err != nil {
+			err = fmt.Errorf(
+				"%w: failed detaching xdp program from interface %q, error: %w",
+				ErrBind,
+				x.name,
+				err,
+			)
+		}
+	}
+
+	x.release()
+
+	return err
+}
+
+func (x *xdpInterface) release() {
+	for _, s := range x.sockets {
+		s.close()
+	}
+
+	x.sockets = nil
+
+	if x.progFD >= 0 {
+		_ = unix.Close(x.progFD)
+	}
+
+	if x.mapFD >= 0 {
+		_ = unix.Close(x.mapFD)
+	}
+}
+
+// xdpRing is one of the four AF_XDP rings -- fill, completion, rx or tx.
+type xdpRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	flags    *uint32
+	descs    unsafe.Pointer
+	mask     uint32
+}
+
+func mmapXDPRing(
+	fd int,
+	offsets *unix.XDPRingOffset,
+	pgoff int64,
+	entries int,
+	descSize int,
+) (xdpRing, error) {
+	mem, err := unix.Mmap(
+		fd,
+		pgoff,
+		int(offsets.Desc)+entries*descSize,
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED|unix.MAP_POPULATE,
+	)
+	if err != nil {
+		return xdpRing{}, err
+	}
+
+	return xdpRing{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Pointer(&mem[offsets.Producer])),
+		consumer: (*uint32)(unsafe.Pointer(&mem[offsets.Consumer])),
+		flags:    (*uint32)(unsafe.Pointer(&mem[offsets.Flags])),
+		descs:    unsafe.Pointer(&mem[offsets.Desc]),
+		mask:     uint32(entries - 1),
+	}, nil
+}
+
+// addr returns the umem address slot at i in a fill or completion ring.
+func (r *xdpRing) addr(i uint32) *uint64 {
+	return (*uint64)(unsafe.Add(r.descs, uintptr(i&r.mask)*8)) //nolint:gomnd
+}
+
+// desc returns the descriptor at i in an rx or tx ring.
+func (r *xdpRing) desc(i uint32) *unix.XDPDesc {
+	return (*unix.XDPDesc)(unsafe.Add(r.descs, uintptr(i&r.mask)*unsafe.Sizeof(unix.XDPDesc{})))
+}
+
+func (r *xdpRing) unmap() {
+	if r.mem != nil {
+		_ = unix.Munmap(r.mem)
+	}
+}
+
+// xdpSocket is a single AF_XDP socket bound to one queue of an interface.
+type xdpSocket struct {
+	fd    int
+	queue int
+	umem  []byte
+
+	fill       xdpRing
+	completion xdpRing
+	rx         xdpRing
+	tx         xdpRing
+
+	// txFrames are umem frames available for transmitting.
+	txFrames []uint64
+}
+
+func newXDPSocket(ifindex, queue int) (*xdpSocket, error) {
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &xdpSocket{
+		fd:    fd,
+		queue: queue,
+	}
+
+	err = s.setup(ifindex)
+	if err != nil {
+		s.close()
+
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *xdpSocket) setup(ifindex int) error {
+	var err error
+
+	s.umem, err = unix.Mmap(
+		-1,
+		0,
+		XDPFrameSize*XDPFrameCount,
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE,
+	)
+	if err != nil {
+		return err
+	}
+
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&s.umem[0]))),
+		Len:  uint64(len(s.umem)),
+		Size: XDPFrameSize,
+	}
+
+	_, _, errno := unix.Syscall6(
+		unix.SYS_SETSOCKOPT,
+		uintptr(s.fd),
+		unix.SOL_XDP,
+		unix.XDP_UMEM_REG,
+		uintptr(unsafe.Pointer(&reg)),
+		unsafe.Sizeof(reg),
+		0,
+	)
+	if errno != 0 {
+		return errno
+	}
+
+	for _, ringOpt := range []int{
+		unix.XDP_UMEM_FILL_RING,
+		unix.XDP_UMEM_COMPLETION_RING,
+		unix.XDP_RX_RING,
+		unix.XDP_TX_RING,
+	} {
+		err = unix.SetsockoptInt(s.fd, unix.SOL_XDP, ringOpt, XDPRingSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	var offsets unix.XDPMmapOffsets
+
+	offsetsLen := uint32(unsafe.Sizeof(offsets))
+
+	_, _, errno = unix.Syscall6(
+		unix.SYS_GETSOCKOPT,
+		uintptr(s.fd),
+		unix.SOL_XDP,
+		unix.XDP_MMAP_OFFSETS,
+		uintptr(unsafe.Pointer(&offsets)),
+		uintptr(unsafe.Pointer(&offsetsLen)),
+		0,
+	)
+	if errno != 0 {
+		return errno
+	}
+
+	descSize := int(unsafe.Sizeof(unix.XDPDesc{}))
+
+	s.fill, err = mmapXDPRing(
+		s.fd, &offsets.Fr, unix.XDP_UMEM_PGOFF_FILL_RING, XDPRingSize, 8, //nolint:gomnd
+	)
+	if err != nil {
+		return err
+	}
+
+	s.completion, err = mmapXDPRing(
+		s.fd, &offsets.Cr, unix.XDP_UMEM_PGOFF_COMPLETION_RING, XDPRingSize, 8, //nolint:gomnd
+	)
+	if err != nil {
+		return err
+	}
+
+	s.rx, err = mmapXDPRing(s.fd, &offsets.Rx, unix.XDP_PGOFF_RX_RING, XDPRingSize, descSize)
+	if err != nil {
+		return err
+	}
+
+	s.tx, err = mmapXDPRing(s.fd, &offsets.Tx, unix.XDP_PGOFF_TX_RING, XDPRingSize, descSize)
+	if err != nil {
+		return err
+	}
+
+	// first half of the umem is for receiving (handed to the kernel via the fill ring), second
+	// half is for transmitting
+	for i := 0; i < XDPFrameCount/2; i++ {
+		*s.fill.addr(uint32(i)) = uint64(i * XDPFrameSize)
+	}
+
+	atomic.StoreUint32(s.fill.producer, XDPFrameCount/2)
+
+	for i := XDPFrameCount / 2; i < XDPFrameCount; i++ {
+		s.txFrames = append(s.txFrames, uint64(i*XDPFrameSize))
+	}
+
+	return unix.Bind(s.fd, &unix.SockaddrXDP{
+		Flags:   unix.XDP_USE_NEED_WAKEUP,
+		Ifindex: uint32(ifindex),
+		QueueID: uint32(s.queue),
+	})
+}
+
+// receive appends any frames waiting in the rx ring to frames, handing their umem frames back to
+// the kernel via the fill ring.
+func (s *xdpSocket) receive(frames []Bytes) []Bytes {
+	consumer := *s.rx.consumer
+	producer := atomic.LoadUint32(s.rx.producer)
+
+	if consumer == producer {
+		return frames
+	}
+
+	fillProducer := *s.fill.producer
+
+	for i := consumer; i != producer; i++ {
+		desc := s.rx.desc(i)
+
+		frame := make(Bytes, desc.Len)
+		copy(frame, s.umem[desc.Addr:desc.Addr+uint64(desc.Len)])
+
+		frames = append(frames, frame)
+
+		// the descriptor address may include headroom, give the kernel back the whole frame
+		*s.fill.addr(fillProducer) = desc.Addr &^ (XDPFrameSize - 1)
+		fillProducer++
+	}
+
+	atomic.StoreUint32(s.rx.consumer, producer)
+	atomic.StoreUint32(s.fill.producer, fillProducer)
+
+	return frames
+}
+
+// reclaim moves umem frames the kernel has finished transmitting back to the available list.
+func (s *xdpSocket) reclaim() {
+	consumer := *s.completion.consumer
+	producer := atomic.LoadUint32(s.completion.producer)
+
+	for i := consumer; i != producer; i++ {
+		s.txFrames = append(s.txFrames, *s.completion.addr(i))
+	}
+
+	atomic.StoreUint32(s.completion.consumer, producer)
+}
+
+func (s *xdpSocket) kick() error {
+	err := unix.Sendto(s.fd, nil, unix.MSG_DONTWAIT, nil)
+	if err != nil &&
+		!errors.Is(err, unix.EAGAIN) &&
+		!errors.Is(err, unix.EBUSY) &&
+		!errors.Is(err, unix.ENOBUFS) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *xdpSocket) transmit(b Bytes, closing *atomic.Bool) error {
+	s.reclaim()
+
+	for len(s.txFrames) == 0 {
+		if closing.Load() {
+			return fmt.Errorf("%w: af_xdp socket", os.ErrClosed)
+		}
+
+		// out of frames, make sure the kernel is working on the tx ring and wait for it
+		err := s.kick()
+		if err != nil {
+			return err
+		}
+
+		_, err = unix.Poll(
+			[]unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLOUT}}, RingPollTimeoutMs,
+		)
+		if err != nil && !errors.Is(err, unix.EINTR) {
+			return err
+		}
+
+		s.reclaim()
+	}
+
+	addr := s.txFrames[len(s.txFrames)-1]
+	s.txFrames = s.txFrames[:len(s.txFrames)-1]
+
+	copy(s.umem[addr:], b)
+
+	producer := *s.tx.producer
+
+	desc := s.tx.desc(producer)
+	desc.Addr = addr
+	desc.Len = uint32(len(b))
+	desc.Options = 0
+
+	atomic.StoreUint32(s.tx.producer, producer+1)
+
+	if atomic.LoadUint32(s.tx.flags)&unix.XDP_RING_NEED_WAKEUP != 0 {
+		return s.kick()
+	}
+
+	return nil
+}
+
+func (s *xdpSocket) close() {
+	s.fill.unmap()
+	s.completion.unmap()
+	s.rx.unmap()
+	s.tx.unmap()
+
+	_ = unix.Close(s.fd)
+
+	if s.umem != nil {
+		_ = unix.Munmap(s.umem)
+	}
+}